@@ -0,0 +1,151 @@
+// Package ban tracks misbehaving peers and blocked IP ranges
+package ban
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hash failures attributed to a peer before it is banned
+const DefaultThreshold = 3
+
+// List holds banned peers, their strikes and blocked ranges.
+// It is safe for concurrent use and can be shared between torrents.
+// A nil List bans nothing
+type List struct {
+	// strikes before a peer is banned
+	Threshold int
+
+	mu      sync.Mutex
+	banned  map[string]string
+	strikes map[string]int
+	ranges  []ipRange
+	// bans are appended here when set
+	file *os.File
+}
+
+func New(threshold int) *List {
+	return &List{
+		Threshold: threshold,
+		banned:    map[string]string{},
+		strikes:   map[string]int{},
+	}
+}
+
+// Open loads bans persisted in path and appends new ones to it.
+// Each line is `ip<TAB>unix time<TAB>reason`
+func Open(path string, threshold int) (*List, error) {
+	l := New(threshold)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), "\t", 3)
+		if len(fields) == 0 || fields[0] == "" {
+			continue
+		}
+		reason := ""
+		if len(fields) == 3 {
+			reason = fields[2]
+		}
+		l.banned[fields[0]] = reason
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l.file = f
+	return l, nil
+}
+
+// Close closes the persistent ban file
+func (l *List) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Banned reports whether ip was banned or falls in a blocked range
+func (l *List) Banned(ip net.IP) bool {
+	if l == nil || ip == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.banned[ip.String()]; ok {
+		return true
+	}
+	return l.blocked(ip)
+}
+
+// Strike records misbehaviour for ip and bans it once Threshold is reached.
+// Returns whether ip is now banned
+func (l *List) Strike(ip net.IP, reason string) bool {
+	if l == nil || ip == nil {
+		return false
+	}
+	l.mu.Lock()
+	key := ip.String()
+	l.strikes[key]++
+	strikes := l.strikes[key]
+	l.mu.Unlock()
+
+	if strikes < l.Threshold {
+		return false
+	}
+	l.Ban(ip, fmt.Sprintf("%s (%d strikes)", reason, strikes))
+	return true
+}
+
+// Ban bans ip immediately and persists it
+func (l *List) Ban(ip net.IP, reason string) {
+	if l == nil || ip == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ip.String()
+	if _, ok := l.banned[key]; ok {
+		return
+	}
+	l.banned[key] = reason
+	delete(l.strikes, key)
+
+	if l.file != nil {
+		fmt.Fprintf(l.file, "%s\t%s\t%s\n", key, strconv.FormatInt(time.Now().Unix(), 10), reason)
+	}
+}
+
+// Unban lifts a ban in memory, a persisted ban returns on the next Open
+func (l *List) Unban(ip net.IP) {
+	if l == nil || ip == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.banned, ip.String())
+	delete(l.strikes, ip.String())
+}
+
+// Strikes returns the strikes ip collected so far
+func (l *List) Strikes(ip net.IP) int {
+	if l == nil || ip == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.strikes[ip.String()]
+}
@@ -0,0 +1,89 @@
+package ban
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStrike(t *testing.T) {
+	l := New(3)
+	ip := net.ParseIP("10.0.0.1")
+	for i := 1; i < 3; i++ {
+		if l.Strike(ip, "hash failure") || l.Banned(ip) {
+			t.Fatalf("banned after %d strikes", i)
+		}
+	}
+	if !l.Strike(ip, "hash failure") || !l.Banned(ip) {
+		t.Fatal("not banned at the threshold")
+	}
+	if l.Strikes(ip) != 0 {
+		t.Fatalf("%d strikes kept after the ban", l.Strikes(ip))
+	}
+	if l.Banned(net.ParseIP("10.0.0.2")) {
+		t.Fatal("another peer was banned")
+	}
+}
+
+func TestOpenReloadsBans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans")
+	l, err := Open(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Ban(net.ParseIP("10.0.0.1"), "sent corrupt data")
+	l.Strike(net.ParseIP("10.0.0.2"), "hash failure")
+	l.Strike(net.ParseIP("10.0.0.2"), "hash failure")
+	// strikes alone aren't persisted
+	l.Strike(net.ParseIP("10.0.0.3"), "hash failure")
+	l.Ban(net.ParseIP("2001:db8::1"), "tab\tin reason")
+	// already banned, not written twice
+	l.Ban(net.ParseIP("10.0.0.1"), "again")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Fatalf("ban file has %d lines, want 3:\n%s", n, data)
+	}
+
+	// blank lines are skipped, a bare ip is a ban without reason
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\n10.0.0.4\n")
+	f.Close()
+
+	l, err = Open(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "2001:db8::1", "10.0.0.4"} {
+		if !l.Banned(net.ParseIP(ip)) {
+			t.Errorf("%s not banned after reopening", ip)
+		}
+	}
+	if l.Banned(net.ParseIP("10.0.0.3")) {
+		t.Error("struck peer banned after reopening")
+	}
+
+	// bans made after reopening are appended
+	l.Ban(net.ParseIP("10.0.0.5"), "sent corrupt data")
+	l.Close()
+	l, err = Open(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !l.Banned(net.ParseIP("10.0.0.5")) || !l.Banned(net.ParseIP("10.0.0.1")) {
+		t.Fatal("appended ban lost")
+	}
+}
@@ -0,0 +1,153 @@
+package ban
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// eMule dat entries with an access level above this are allowed
+const datAllowLevel = 127
+
+// inclusive IPv4 range
+type ipRange struct {
+	first, last uint32
+}
+
+// LoadBlocklist adds IPv4 ranges from a blocklist file.
+// Both P2P plaintext (`description:1.2.3.0-1.2.3.255`) and eMule dat
+// (`001.002.003.000 - 001.002.003.255 , 000 , description`) lines are accepted.
+// Returns the number of ranges loaded
+func (l *List) LoadBlocklist(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return l.ReadBlocklist(f)
+}
+
+// ReadBlocklist is LoadBlocklist reading from r
+func (l *List) ReadBlocklist(r io.Reader) (int, error) {
+	var ranges []ipRange
+	sc := bufio.NewScanner(r)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		rng, ok, err := parseBlocklistLine(line)
+		if err != nil {
+			return 0, fmt.Errorf("blocklist line %d: %w", lineNo, err)
+		}
+		if ok {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ranges = mergeRanges(append(l.ranges, ranges...))
+	return len(ranges), nil
+}
+
+// returns false for dat entries that allow rather than block the range
+func parseBlocklistLine(line string) (ipRange, bool, error) {
+	var span string
+	if strings.Contains(line, ",") {
+		// eMule dat: range , level , description
+		fields := strings.SplitN(line, ",", 3)
+		if len(fields) < 2 {
+			return ipRange{}, false, fmt.Errorf("malformed dat entry %q", line)
+		}
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return ipRange{}, false, fmt.Errorf("invalid access level %q", fields[1])
+		}
+		if level > datAllowLevel {
+			return ipRange{}, false, nil
+		}
+		span = fields[0]
+	} else {
+		// P2P: description may contain colons, range follows the last one
+		idx := strings.LastIndex(line, ":")
+		if idx < 0 {
+			return ipRange{}, false, fmt.Errorf("malformed p2p entry %q", line)
+		}
+		span = line[idx+1:]
+	}
+
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return ipRange{}, false, fmt.Errorf("missing range in %q", line)
+	}
+	lo, err := parseIPv4(strings.TrimSpace(first))
+	if err != nil {
+		return ipRange{}, false, err
+	}
+	hi, err := parseIPv4(strings.TrimSpace(last))
+	if err != nil {
+		return ipRange{}, false, err
+	}
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	return ipRange{lo, hi}, true, nil
+}
+
+// dat files zero pad octets which net.ParseIP rejects
+func parseIPv4(s string) (uint32, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return 0, fmt.Errorf("invalid IPv4 address %q", s)
+	}
+	var ip uint32
+	for _, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("invalid IPv4 address %q", s)
+		}
+		ip = ip<<8 | uint32(n)
+	}
+	return ip, nil
+}
+
+// sorts and joins overlapping or adjacent ranges so lookups can binary search
+func mergeRanges(ranges []ipRange) []ipRange {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first < ranges[j].first })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if last.last == ^uint32(0) || r.first <= last.last+1 {
+			last.last = max(last.last, r.last)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// caller holds l.mu
+func (l *List) blocked(ip net.IP) bool {
+	v4 := ip.To4()
+	if v4 == nil || len(l.ranges) == 0 {
+		return false
+	}
+	n := binary.BigEndian.Uint32(v4)
+	// first range ending at or after n
+	idx := sort.Search(len(l.ranges), func(i int) bool { return l.ranges[i].last >= n })
+	return idx < len(l.ranges) && l.ranges[idx].first <= n
+}
@@ -0,0 +1,133 @@
+package ban
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklistLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    ipRange
+		ok      bool
+		wantErr bool
+	}{
+		// P2P plaintext
+		{line: "Some Org:1.2.3.0-1.2.3.255", want: ipRange{0x01020300, 0x010203ff}, ok: true},
+		{line: "name: with: colons:10.0.0.1 - 10.0.0.9", want: ipRange{0x0a000001, 0x0a000009}, ok: true},
+		{line: "reversed:10.0.0.9-10.0.0.1", want: ipRange{0x0a000001, 0x0a000009}, ok: true},
+		{line: "single:8.8.8.8-8.8.8.8", want: ipRange{0x08080808, 0x08080808}, ok: true},
+		// eMule dat, octets zero padded
+		{line: "001.002.003.000 - 001.002.003.255 , 000 , Some Org", want: ipRange{0x01020300, 0x010203ff}, ok: true},
+		{line: "010.000.000.000 - 010.255.255.255 , 127 , at the limit", want: ipRange{0x0a000000, 0x0affffff}, ok: true},
+		{line: "010.000.000.000 - 010.255.255.255 , 128 , allowed"},
+		{line: "1.2.3.0 - 1.2.3.255 , 0", want: ipRange{0x01020300, 0x010203ff}, ok: true},
+		// malformed
+		{line: "no range here", wantErr: true},
+		{line: "name:1.2.3.4", wantErr: true},
+		{line: "name:1.2.3-1.2.3.9", wantErr: true},
+		{line: "name:1.2.3.256-1.2.3.9", wantErr: true},
+		{line: "name:::1-::2", wantErr: true},
+		{line: "1.2.3.0 - 1.2.3.255 , high , desc", wantErr: true},
+		{line: "1.2.3.0 , 000 , desc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, ok, err := parseBlocklistLine(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ok != tt.ok || (ok && got != tt.want) {
+				t.Fatalf("got %+v, %t, want %+v, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReadBlocklist(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		ranges  int
+		merged  []ipRange
+		blocked []string
+		allowed []string
+		wantErr bool
+	}{
+		{
+			name: "comments and blank lines",
+			list: "# comment\n\n// another\n  \nOrg:1.2.3.0-1.2.3.255\n",
+			ranges: 1, merged: []ipRange{{0x01020300, 0x010203ff}},
+			blocked: []string{"1.2.3.0", "1.2.3.128", "1.2.3.255"},
+			allowed: []string{"1.2.2.255", "1.2.4.0", "::1"},
+		},
+		{
+			name: "both formats",
+			list: "Org:1.2.3.0-1.2.3.255\n005.000.000.000 - 005.000.000.255 , 050 , Other\n006.000.000.000 - 006.000.000.255 , 200 , Allowed\n",
+			ranges: 2, merged: []ipRange{{0x01020300, 0x010203ff}, {0x05000000, 0x050000ff}},
+			blocked: []string{"5.0.0.7"},
+			allowed: []string{"6.0.0.7"},
+		},
+		{
+			name: "overlapping and adjacent merge",
+			list: "a:10.0.0.0-10.0.0.100\nb:10.0.0.50-10.0.0.200\nc:10.0.0.201-10.0.1.0\nd:10.0.2.0-10.0.2.9\ne:10.0.0.10-10.0.0.20\n",
+			ranges: 5, merged: []ipRange{{0x0a000000, 0x0a000100}, {0x0a000200, 0x0a000209}},
+			blocked: []string{"10.0.0.150", "10.0.1.0", "10.0.2.9"},
+			allowed: []string{"10.0.1.1", "10.0.2.10"},
+		},
+		{
+			name: "range up to the last address",
+			list: "a:255.255.255.0-255.255.255.255\nb:255.255.255.10-255.255.255.20\n",
+			ranges: 2, merged: []ipRange{{0xffffff00, 0xffffffff}},
+			blocked: []string{"255.255.255.255"},
+		},
+		{
+			name:    "malformed line",
+			list:    "Org:1.2.3.0-1.2.3.255\ngarbage\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(DefaultThreshold)
+			n, err := l.ReadBlocklist(strings.NewReader(tt.list))
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "line 2") {
+					t.Fatalf("err = %v, want an error on line 2", err)
+				}
+				if len(l.ranges) != 0 {
+					t.Fatalf("failed list loaded %v", l.ranges)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.ranges {
+				t.Fatalf("loaded %d ranges, want %d", n, tt.ranges)
+			}
+			if len(l.ranges) != len(tt.merged) {
+				t.Fatalf("merged into %+v, want %+v", l.ranges, tt.merged)
+			}
+			for i := range tt.merged {
+				if l.ranges[i] != tt.merged[i] {
+					t.Fatalf("merged into %+v, want %+v", l.ranges, tt.merged)
+				}
+			}
+			for _, ip := range tt.blocked {
+				if !l.Banned(net.ParseIP(ip)) {
+					t.Errorf("%s not blocked", ip)
+				}
+			}
+			for _, ip := range tt.allowed {
+				if l.Banned(net.ParseIP(ip)) {
+					t.Errorf("%s blocked", ip)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// RawMessage is an already encoded value. It is captured verbatim when
+// decoding and written verbatim when encoding, so e.g. an info dictionary
+// keeps the exact bytes its hash was taken over
+type RawMessage []byte
+
+// UnmarshalTypeError describes a value that can't be stored in the target type
+type UnmarshalTypeError struct {
+	Kind   TokenKind
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot decode %s into %s at offset %d", e.Kind, e.Type, e.Offset)
+}
+
+// Decoder reads bencoded values from a stream into Go values
+type Decoder struct {
+	t *Tokenizer
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{t: NewTokenizer(r)}
+}
+
+// Strict makes the decoder reject non canonical input
+func (d *Decoder) Strict() *Decoder {
+	d.t.Strict = true
+	return d
+}
+
+// Offset of the next byte to be read
+func (d *Decoder) Offset() int64 {
+	return d.t.Offset()
+}
+
+// Decode reads the next value into v, which must be a non nil pointer.
+//
+// Dictionaries decode into structs, using the field name or its bencode tag
+// ("name,omitempty", "-" to skip), or into maps with string keys. Lists decode
+// into slices and arrays, strings into string, []byte and [N]byte, integers
+// into any int, uint or bool. Into an interface value the generic types are
+// int64, string, []any and map[string]any. RawMessage keeps the encoding as is
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: Decode of non pointer %T", v)
+	}
+	return d.value(rv.Elem())
+}
+
+// Unmarshal decodes a single bencoded value from data into v
+func Unmarshal(data []byte, v any) error {
+	return unmarshal(NewDecoder(bytes.NewReader(data)), v)
+}
+
+// UnmarshalStrict is Unmarshal for input that must be canonically encoded
+func UnmarshalStrict(data []byte, v any) error {
+	return unmarshal(NewDecoder(bytes.NewReader(data)).Strict(), v)
+}
+
+func unmarshal(d *Decoder, v any) error {
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if _, err := d.t.r.ReadByte(); err != io.EOF {
+		return syntaxErr(d.Offset(), "trailing data after value")
+	}
+	return nil
+}
+
+var rawMessageType = reflect.TypeFor[RawMessage]()
+
+func (d *Decoder) value(rv reflect.Value) error {
+	if rv.Type() == rawMessageType {
+		raw, _, err := d.t.Raw()
+		if err != nil {
+			return err
+		}
+		rv.SetBytes(bytes.Clone(raw))
+		return nil
+	}
+
+	tok, err := d.t.Next()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if tok.Kind == TokenEnd {
+		return syntaxErr(tok.Offset, "expected value")
+	}
+	return d.token(tok, rv)
+}
+
+func (d *Decoder) token(tok Token, rv reflect.Value) error {
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return d.token(tok, rv.Elem())
+	}
+	if rv.Kind() == reflect.Interface && rv.NumMethod() == 0 {
+		v, err := d.generic(tok)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+
+	switch tok.Kind {
+	case TokenInt:
+		return d.int(tok, rv)
+	case TokenString:
+		return d.string(tok, rv)
+	case TokenList:
+		return d.list(tok, rv)
+	default:
+		return d.dict(tok, rv)
+	}
+}
+
+func (d *Decoder) mismatch(tok Token, rv reflect.Value) error {
+	if err := d.t.Skip(tok); err != nil {
+		return err
+	}
+	return &UnmarshalTypeError{Kind: tok.Kind, Type: rv.Type(), Offset: tok.Offset}
+}
+
+func (d *Decoder) int(tok Token, rv reflect.Value) error {
+	n := tok.Int
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.OverflowInt(n) {
+			return syntaxErr(tok.Offset, "integer %d overflows %s", n, rv.Type())
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || rv.OverflowUint(uint64(n)) {
+			return syntaxErr(tok.Offset, "integer %d overflows %s", n, rv.Type())
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Bool:
+		rv.SetBool(n != 0)
+	default:
+		return d.mismatch(tok, rv)
+	}
+	return nil
+}
+
+func (d *Decoder) string(tok Token, rv reflect.Value) error {
+	switch {
+	case rv.Kind() == reflect.String:
+		rv.SetString(string(tok.Bytes))
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+		rv.SetBytes(tok.Bytes)
+	case rv.Kind() == reflect.Array && rv.Type().Elem().Kind() == reflect.Uint8:
+		if len(tok.Bytes) != rv.Len() {
+			return syntaxErr(tok.Offset, "string of length %d into %s", len(tok.Bytes), rv.Type())
+		}
+		reflect.Copy(rv, reflect.ValueOf(tok.Bytes))
+	default:
+		return d.mismatch(tok, rv)
+	}
+	return nil
+}
+
+func (d *Decoder) list(tok Token, rv reflect.Value) error {
+	switch rv.Kind() {
+	case reflect.Slice:
+		rv.Set(reflect.MakeSlice(rv.Type(), 0, 0))
+		for d.t.More() {
+			rv.Set(reflect.Append(rv, reflect.Zero(rv.Type().Elem())))
+			if err := d.value(rv.Index(rv.Len() - 1)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		n := 0
+		for ; d.t.More(); n++ {
+			if n >= rv.Len() {
+				return syntaxErr(tok.Offset, "list too long for %s", rv.Type())
+			}
+			if err := d.value(rv.Index(n)); err != nil {
+				return err
+			}
+		}
+		if n != rv.Len() {
+			return syntaxErr(tok.Offset, "list of length %d into %s", n, rv.Type())
+		}
+	default:
+		return d.mismatch(tok, rv)
+	}
+	return d.end()
+}
+
+// consumes the end of the current list
+func (d *Decoder) end() error {
+	tok, err := d.t.Next()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if tok.Kind != TokenEnd {
+		return syntaxErr(tok.Offset, "expected end of list")
+	}
+	return nil
+}
+
+func (d *Decoder) dict(tok Token, rv reflect.Value) error {
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return d.mismatch(tok, rv)
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		return d.t.Dict(func(key string) error {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := d.value(elem); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), elem)
+			return nil
+		})
+	case reflect.Struct:
+		fields := cachedFields(rv.Type())
+		return d.t.Dict(func(key string) error {
+			f, ok := fields.byName[key]
+			if !ok {
+				// unknown keys are allowed, torrents carry plenty of them
+				return d.t.SkipValue()
+			}
+			return d.value(rv.FieldByIndex(f.index))
+		})
+	default:
+		return d.mismatch(tok, rv)
+	}
+}
+
+// decodes into int64, string, []any and map[string]any
+func (d *Decoder) generic(tok Token) (any, error) {
+	switch tok.Kind {
+	case TokenInt:
+		return tok.Int, nil
+	case TokenString:
+		return string(tok.Bytes), nil
+	case TokenList:
+		list := []any{}
+		for {
+			next, err := d.t.Next()
+			if err != nil {
+				return nil, err
+			}
+			if next.Kind == TokenEnd {
+				return list, nil
+			}
+			v, err := d.generic(next)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case TokenDict:
+		dict := map[string]any{}
+		err := d.t.Dict(func(key string) error {
+			next, err := d.t.Next()
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			v, err := d.generic(next)
+			dict[key] = v
+			return err
+		})
+		return dict, err
+	default:
+		return nil, errors.New("bencode: unexpected end")
+	}
+}
@@ -0,0 +1,126 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// real world input: a .torrent and tracker announce and scrape responses,
+// plus malformed and non canonical values
+func addSeeds(f *testing.F) {
+	paths, err := filepath.Glob("testdata/tracker/*")
+	if err != nil {
+		f.Fatal(err)
+	}
+	paths = append(paths, "../testfile/debian.iso.torrent")
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	for _, s := range []string{
+		"i0e", "i-42e", "0:", "4:spam", "le", "de", "li1ei2ee", "d1:ai1e1:bl1:cee",
+		// not canonical
+		"i-0e", "i03e", "03:abc", "d1:bi1e1:ai2ee", "d1:ai1e1:ai2ee",
+		// malformed
+		"", "e", "i", "ie", "i1", "5:abc", "l", "d1:ae", "di1ei2ee", "x",
+		"i99999999999999999999e", "1:ai1e",
+	} {
+		f.Add([]byte(s))
+	}
+	// nesting at and past the limit
+	f.Add([]byte(strings.Repeat("l", maxDepth) + strings.Repeat("e", maxDepth)))
+	f.Add([]byte(strings.Repeat("l", maxDepth+1) + strings.Repeat("e", maxDepth+1)))
+	f.Add([]byte(strings.Repeat("d1:a", maxDepth+1) + "i0e" + strings.Repeat("e", maxDepth+1)))
+}
+
+type fuzzFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type fuzzInfo struct {
+	Name        string     `bencode:"name"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Length      int64      `bencode:"length,omitempty"`
+	Files       []fuzzFile `bencode:"files,omitempty"`
+	Private     bool       `bencode:"private,omitempty"`
+}
+
+type fuzzTorrent struct {
+	Announce     string                    `bencode:"announce"`
+	AnnounceList [][]string                `bencode:"announce-list"`
+	Info         RawMessage                `bencode:"info"`
+	Decoded      *fuzzInfo                 `bencode:"info-decoded"`
+	Peers        RawMessage                `bencode:"peers"`
+	Interval     uint16                    `bencode:"interval"`
+	Files        map[string]map[string]int `bencode:"files"`
+	Hash         [20]byte                  `bencode:"hash"`
+	Pair         [2]int                    `bencode:"pair"`
+	Extra        any                       `bencode:"extra"`
+	Skipped      string                    `bencode:"-"`
+}
+
+func FuzzDecode(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// typed targets may fail but must not panic
+		var tor fuzzTorrent
+		Unmarshal(data, &tor)
+		var info fuzzInfo
+		Unmarshal(data, &info)
+
+		var raw RawMessage
+		if err := Unmarshal(data, &raw); err == nil && !bytes.Equal(raw, data) {
+			t.Fatalf("RawMessage captured %q of %q", raw, data)
+		}
+
+		var v any
+		if err := Unmarshal(data, &v); err != nil {
+			return
+		}
+		enc, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal of decoded %#v: %v", v, err)
+		}
+		var again any
+		if err := UnmarshalStrict(enc, &again); err != nil {
+			t.Fatalf("Marshal output %q isn't canonical: %v", enc, err)
+		}
+		if !reflect.DeepEqual(v, again) {
+			t.Fatalf("round trip changed %#v to %#v", v, again)
+		}
+
+		// canonical input comes back byte for byte
+		if err := UnmarshalStrict(data, &again); err == nil && !bytes.Equal(enc, data) {
+			t.Fatalf("canonical %q encoded as %q", data, enc)
+		}
+	})
+}
+
+func TestDepthLimit(t *testing.T) {
+	var v any
+	ok := strings.Repeat("l", maxDepth) + strings.Repeat("e", maxDepth)
+	if err := Unmarshal([]byte(ok), &v); err != nil {
+		t.Fatalf("%d levels: %v", maxDepth, err)
+	}
+
+	// would overflow the stack without the limit
+	deep := bytes.Repeat([]byte("l"), 20<<20)
+	var serr *SyntaxError
+	if err := Unmarshal(deep, &v); !errors.As(err, &serr) || serr.Offset != maxDepth {
+		t.Fatalf("got %v, want a syntax error at offset %d", err, maxDepth)
+	}
+	var raw RawMessage
+	if err := Unmarshal(deep, &raw); !errors.As(err, &serr) {
+		t.Fatalf("RawMessage: got %v, want a syntax error", err)
+	}
+}
@@ -0,0 +1,145 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Marshal returns the canonical encoding of v: dictionary keys are sorted and
+// integers carry no leading zeros. bool encodes as i0e or i1e
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encoder writes bencoded values to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) Encode(v any) error {
+	var buf bytes.Buffer
+	if err := encode(&buf, reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+func encode(buf *bytes.Buffer, rv reflect.Value) error {
+	if !rv.IsValid() {
+		return fmt.Errorf("bencode: cannot encode nil")
+	}
+	if rv.Type() == rawMessageType {
+		if rv.Len() == 0 {
+			return fmt.Errorf("bencode: empty RawMessage")
+		}
+		buf.Write(rv.Bytes())
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return fmt.Errorf("bencode: cannot encode nil %s", rv.Type())
+		}
+		return encode(buf, rv.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeInt(buf, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(rv.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.Bool:
+		n := int64(0)
+		if rv.Bool() {
+			n = 1
+		}
+		writeInt(buf, n)
+	case reflect.String:
+		writeString(buf, rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			writeString(buf, string(b))
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := range rv.Len() {
+			if err := encode(buf, rv.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("bencode: map key type %s is not a string", rv.Type().Key())
+		}
+		keys := rv.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+		buf.WriteByte('d')
+		for _, k := range keys {
+			writeString(buf, k.String())
+			if err := encode(buf, rv.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		buf.WriteByte('d')
+		for _, f := range cachedFields(rv.Type()).sorted {
+			fv := rv.FieldByIndex(f.index)
+			if f.omitEmpty && isEmpty(fv) {
+				continue
+			}
+			if (fv.Kind() == reflect.Pointer || fv.Kind() == reflect.Interface) && fv.IsNil() {
+				// nothing to write for a missing optional value
+				continue
+			}
+			writeString(buf, f.name)
+			if err := encode(buf, fv); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: cannot encode %s", rv.Type())
+	}
+	return nil
+}
+
+func writeInt(buf *bytes.Buffer, n int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(n, 10))
+	buf.WriteByte('e')
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
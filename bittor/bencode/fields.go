@@ -0,0 +1,54 @@
+package bencode
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type structFields struct {
+	// in key order, which is the canonical encoding order
+	sorted []field
+	byName map[string]field
+}
+
+var fieldCache sync.Map
+
+func cachedFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.(*structFields)
+}
+
+func typeFields(t reflect.Type) *structFields {
+	fields := &structFields{byName: map[string]field{}}
+	for _, sf := range reflect.VisibleFields(t) {
+		if !sf.IsExported() || sf.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(sf.Tag.Get("bencode"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		f := field{name: name, index: sf.Index, omitEmpty: opts == "omitempty"}
+		if _, dup := fields.byName[name]; dup {
+			continue
+		}
+		fields.byName[name] = f
+		fields.sorted = append(fields.sorted, f)
+	}
+	slices.SortFunc(fields.sorted, func(a, b field) int { return strings.Compare(a.name, b.name) })
+	return fields
+}
@@ -0,0 +1,371 @@
+// Package bencode encodes and decodes the bencoding used by torrent files,
+// trackers and peer extension messages
+// https://www.bittorrent.org/beps/bep_0003.html#bencoding
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// longest string the tokenizer will allocate for, guards against bogus lengths
+const maxTokenString = 64 << 20
+
+// deepest list and dictionary nesting accepted, the decoder recurses once per
+// level so deeper input could exhaust the stack
+const maxDepth = 512
+
+type TokenKind uint8
+
+const (
+	TokenInt TokenKind = iota
+	TokenString
+	// start of a list, its items follow until TokenEnd
+	TokenList
+	// start of a dictionary, alternating string keys and values follow until TokenEnd
+	TokenDict
+	// closes the innermost list or dictionary
+	TokenEnd
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenInt:
+		return "int"
+	case TokenString:
+		return "string"
+	case TokenList:
+		return "list"
+	case TokenDict:
+		return "dict"
+	case TokenEnd:
+		return "end"
+	default:
+		return fmt.Sprintf("Unknown%d", k)
+	}
+}
+
+type Token struct {
+	Kind TokenKind
+	// value of TokenInt
+	Int int64
+	// value of TokenString
+	Bytes []byte
+	// byte offset in the stream where the token starts
+	Offset int64
+}
+
+// SyntaxError describes malformed or, in strict mode, non canonical input
+type SyntaxError struct {
+	Offset int64
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+func syntaxErr(off int64, format string, args ...any) error {
+	return &SyntaxError{Offset: off, msg: fmt.Sprintf(format, args...)}
+}
+
+// an open list or dictionary
+type frame struct {
+	dict bool
+	// next token in a dictionary is a key
+	wantKey bool
+	lastKey []byte
+	hasKey  bool
+}
+
+// Tokenizer reads bencoded values from a stream one token at a time, so
+// large or untrusted input (torrents, tracker and DHT responses) can be
+// walked without decoding it whole. Raw captures the exact encoding of a
+// value, which is what info hashes are taken over
+type Tokenizer struct {
+	// Strict rejects input that isn't canonical: integers and lengths with
+	// leading zeros, negative zero, unsorted or duplicate dictionary keys
+	Strict bool
+
+	r     *bufio.Reader
+	off   int64
+	stack []frame
+	// raw bytes of the value being captured by Raw
+	capture *bytes.Buffer
+}
+
+func NewTokenizer(r io.Reader) *Tokenizer {
+	return &Tokenizer{r: bufio.NewReader(r)}
+}
+
+// Offset of the next byte to be read
+func (t *Tokenizer) Offset() int64 {
+	return t.off
+}
+
+// Depth of list and dictionary nesting at the current position
+func (t *Tokenizer) Depth() int {
+	return len(t.stack)
+}
+
+func (t *Tokenizer) readByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	t.off++
+	if t.capture != nil {
+		t.capture.WriteByte(b)
+	}
+	return b, nil
+}
+
+// reads up to and excluding delim
+func (t *Tokenizer) readUntil(delim byte) ([]byte, error) {
+	var buf []byte
+	for {
+		b, err := t.readByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if b == delim {
+			return buf, nil
+		}
+		// ints and string lengths, anything longer is malformed
+		if len(buf) > 20 {
+			return nil, syntaxErr(t.off, "number too long")
+		}
+		buf = append(buf, b)
+	}
+}
+
+// Next returns the next token. io.EOF is returned only between top level values
+func (t *Tokenizer) Next() (Token, error) {
+	start := t.off
+	c, err := t.readByte()
+	if err != nil {
+		if len(t.stack) > 0 {
+			return Token{}, unexpectedEOF(err)
+		}
+		return Token{}, err
+	}
+
+	if c == 'e' {
+		if len(t.stack) == 0 {
+			return Token{}, syntaxErr(start, "unexpected end")
+		}
+		if top := t.stack[len(t.stack)-1]; top.dict && !top.wantKey {
+			return Token{}, syntaxErr(start, "dictionary key without value")
+		}
+		t.stack = t.stack[:len(t.stack)-1]
+		return Token{Kind: TokenEnd, Offset: start}, nil
+	}
+
+	tok, err := t.readValueToken(c, start)
+	if err != nil {
+		return Token{}, err
+	}
+	if err := t.advance(tok); err != nil {
+		return Token{}, err
+	}
+	if tok.Kind == TokenList || tok.Kind == TokenDict {
+		if len(t.stack) >= maxDepth {
+			return Token{}, syntaxErr(start, "nested deeper than %d", maxDepth)
+		}
+		t.stack = append(t.stack, frame{dict: tok.Kind == TokenDict, wantKey: true})
+	}
+	return tok, nil
+}
+
+func (t *Tokenizer) readValueToken(c byte, start int64) (Token, error) {
+	switch {
+	case c == 'i':
+		digits, err := t.readUntil('e')
+		if err != nil {
+			return Token{}, err
+		}
+		if t.Strict && !canonicalInt(digits) {
+			return Token{}, syntaxErr(start, "non canonical integer %q", digits)
+		}
+		n, err := strconv.ParseInt(string(digits), 10, 64)
+		if err != nil {
+			return Token{}, syntaxErr(start, "invalid integer %q", digits)
+		}
+		return Token{Kind: TokenInt, Int: n, Offset: start}, nil
+	case c == 'l':
+		return Token{Kind: TokenList, Offset: start}, nil
+	case c == 'd':
+		return Token{Kind: TokenDict, Offset: start}, nil
+	case c >= '0' && c <= '9':
+		digits, err := t.readUntil(':')
+		if err != nil {
+			return Token{}, err
+		}
+		digits = append([]byte{c}, digits...)
+		if t.Strict && len(digits) > 1 && digits[0] == '0' {
+			return Token{}, syntaxErr(start, "string length with leading zero")
+		}
+		n, err := strconv.Atoi(string(digits))
+		if err != nil || n > maxTokenString {
+			return Token{}, syntaxErr(start, "invalid string length %q", digits)
+		}
+		buf, err := readString(t.r, n)
+		if err != nil {
+			return Token{}, err
+		}
+		t.off += int64(n)
+		if t.capture != nil {
+			t.capture.Write(buf)
+		}
+		return Token{Kind: TokenString, Bytes: buf, Offset: start}, nil
+	default:
+		return Token{}, syntaxErr(start, "unexpected byte %q", c)
+	}
+}
+
+// strings up to this length are read into a buffer of their full size, longer
+// ones grow as data arrives so a bogus length can't allocate much on its own
+const stringChunk = 64 << 10
+
+func readString(r io.Reader, n int) ([]byte, error) {
+	if n <= stringChunk {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return buf, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// tracks key/value alternation of the enclosing dictionary
+func (t *Tokenizer) advance(tok Token) error {
+	if len(t.stack) == 0 {
+		return nil
+	}
+	top := &t.stack[len(t.stack)-1]
+	if !top.dict {
+		return nil
+	}
+	if !top.wantKey {
+		top.wantKey = true
+		return nil
+	}
+
+	if tok.Kind != TokenString {
+		return syntaxErr(tok.Offset, "dictionary key is a %s", tok.Kind)
+	}
+	if t.Strict && top.hasKey {
+		switch cmp := bytes.Compare(tok.Bytes, top.lastKey); {
+		case cmp == 0:
+			return syntaxErr(tok.Offset, "duplicate dictionary key %q", tok.Bytes)
+		case cmp < 0:
+			return syntaxErr(tok.Offset, "dictionary key %q out of order", tok.Bytes)
+		}
+	}
+	top.lastKey, top.hasKey, top.wantKey = tok.Bytes, true, false
+	return nil
+}
+
+// 0, or an optional minus followed by digits without leading zero
+func canonicalInt(digits []byte) bool {
+	if len(digits) == 0 {
+		return false
+	}
+	if string(digits) == "0" {
+		return true
+	}
+	if digits[0] == '-' {
+		digits = digits[1:]
+	}
+	return len(digits) > 0 && digits[0] >= '1' && digits[0] <= '9'
+}
+
+// More reports whether the current list or dictionary has another item
+// before its end
+func (t *Tokenizer) More() bool {
+	b, err := t.r.Peek(1)
+	return err == nil && b[0] != 'e'
+}
+
+// Skip consumes the rest of a value whose first token was tok
+func (t *Tokenizer) Skip(tok Token) error {
+	if tok.Kind != TokenList && tok.Kind != TokenDict {
+		return nil
+	}
+	depth := len(t.stack) - 1
+	for len(t.stack) > depth {
+		if _, err := t.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Raw consumes the next value and returns its exact encoding along with the
+// offset it started at
+func (t *Tokenizer) Raw() ([]byte, int64, error) {
+	if t.capture != nil {
+		return nil, 0, errors.New("bencode: nested raw capture")
+	}
+	t.capture = &bytes.Buffer{}
+	defer func() { t.capture = nil }()
+
+	start := t.off
+	tok, err := t.Next()
+	if err != nil {
+		return nil, 0, err
+	}
+	if tok.Kind == TokenEnd {
+		return nil, 0, syntaxErr(start, "expected value")
+	}
+	if err := t.Skip(tok); err != nil {
+		return nil, 0, err
+	}
+	return t.capture.Bytes(), start, nil
+}
+
+// Dict walks a dictionary whose TokenDict was just read, calling fn with each
+// key. fn must consume exactly one value, e.g. with Next, Skip or Raw
+func (t *Tokenizer) Dict(fn func(key string) error) error {
+	for {
+		tok, err := t.Next()
+		if err != nil {
+			return err
+		}
+		if tok.Kind == TokenEnd {
+			return nil
+		}
+		// the tokenizer already rejected non string keys
+		if err := fn(string(tok.Bytes)); err != nil {
+			return err
+		}
+	}
+}
+
+// SkipValue consumes the next value entirely
+func (t *Tokenizer) SkipValue() error {
+	tok, err := t.Next()
+	if err != nil {
+		return err
+	}
+	if tok.Kind == TokenEnd {
+		return syntaxErr(tok.Offset, "expected value")
+	}
+	return t.Skip(tok)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
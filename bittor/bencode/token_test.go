@@ -0,0 +1,47 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func FuzzTokenizer(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tok := NewTokenizer(bytes.NewReader(data))
+		last := int64(-1)
+		for {
+			before := tok.Offset()
+			tk, err := tok.Next()
+			if err != nil {
+				break
+			}
+			if tk.Offset != before || tk.Offset <= last {
+				t.Fatalf("token %v at offset %d, previous at %d, reader at %d", tk.Kind, tk.Offset, last, before)
+			}
+			if tok.Offset() > int64(len(data)) {
+				t.Fatalf("offset %d past the end of %d bytes", tok.Offset(), len(data))
+			}
+			last = tk.Offset
+		}
+
+		// Raw captures exactly the bytes of the first value
+		tok = NewTokenizer(bytes.NewReader(data))
+		raw, off, err := tok.Raw()
+		if err != nil {
+			return
+		}
+		if off != 0 || !bytes.Equal(raw, data[:len(raw)]) || tok.Offset() != int64(len(raw)) {
+			t.Fatalf("Raw returned %q at %d for %q", raw, off, data)
+		}
+		if tok.Depth() != 0 {
+			t.Fatalf("depth %d after a whole value", tok.Depth())
+		}
+		if len(raw) == len(data) {
+			if _, err := tok.Next(); err != io.EOF {
+				t.Fatalf("expected EOF after the only value, got %v", err)
+			}
+		}
+	})
+}
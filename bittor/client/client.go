@@ -6,12 +6,16 @@ import (
 	"bittor/message"
 	"bittor/peer"
 	"bytes"
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
-// TCP connection with peer
+// TCP connection with peer.
+// After the handshake a reader and a writer goroutine own the connection so
+// sending never waits on a pending read and vice versa
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
@@ -19,6 +23,17 @@ type Client struct {
 	peer     peer.Peer
 	infoHash [20]byte
 	peerID   [20]byte
+
+	// messages read by the reader loop, closed when it stops
+	msgs chan *message.Message
+	// serialized messages waiting for the writer loop
+	out chan queued
+	// closed by Close
+	done      chan struct{}
+	closeOnce sync.Once
+
+	errMu sync.Mutex
+	err   error
 }
 
 func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Handshake, error) {
@@ -41,84 +56,159 @@ func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-func recvBitField(conn net.Conn) (bitfield.Bitfield, error) {
+// reads the peer's bitfield. It is optional for peers without pieces, any
+// other first message is returned to be delivered as usual
+func recvBitField(conn net.Conn) (bitfield.Bitfield, *message.Message, error) {
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // reset deadline
 
-	msg, err := message.Read(conn)
+	// keep-alives may come first
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		if msg == nil {
+			continue
+		}
+		if msg.ID != message.MsgBitfield {
+			return nil, msg, nil
+		}
+		return msg.Payload, nil, nil
+	}
+}
+
+// New connects with a peer, completes a handshake, and receives a handshake.
+// Cancelling ctx aborts the dial and handshake
+func New(ctx context.Context, peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	conn, err := Dial(ctx, peer)
 	if err != nil {
 		return nil, err
 	}
-	if msg.ID != message.MsgBitfield {
-		return nil, fmt.Errorf("expected bitfield message but received %d", msg.ID)
-	}
-	return msg.Payload, nil
+	return Handshake(ctx, conn, peer, peerID, infoHash)
 }
 
-// New connects with a peer, completes a handshake, and receives a handshake
-func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
+// Dial opens the TCP connection to peer, Handshake completes it
+func Dial(ctx context.Context, peer peer.Peer) (net.Conn, error) {
 	// Timeout set to 3 seconds
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
-	if err != nil {
+	d := net.Dialer{Timeout: 3 * time.Second}
+	return d.DialContext(ctx, "tcp", peer.String())
+}
+
+// Handshake runs our side of the handshake on a connection we opened, e.g.
+// one wrapped by a recorder or a replayed session. conn is closed on error
+func Handshake(ctx context.Context, conn net.Conn, peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	// unblocks handshake reads when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := completeHandshake(conn, infoHash, peerID); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	if _, err := completeHandshake(conn, infoHash, peerID); err != nil {
+	bf, first, err := recvBitField(conn)
+	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	if !stop() {
+		// ctx was cancelled and conn closed right after the handshake
+		return nil, ctx.Err()
+	}
 
-	bf, err := recvBitField(conn)
+	return newClient(conn, bf, first, peer, infoHash, peerID), nil
+}
+
+// Accept completes a handshake on a connection opened by a remote peer.
+// The remote handshake was already read by the listener to route the
+// connection to its torrent. have is sent as our bitfield, empty sends none.
+// The peer's bitfield isn't waited for, a peer with nothing to announce may
+// wait on us. If it sends one it is the first message read
+func Accept(conn net.Conn, remote *handshake.Handshake, peerID [20]byte, have bitfield.Bitfield) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	res := handshake.New(remote.InfoHash, peerID)
+	buf := res.Serialize()
+	if len(have) > 0 {
+		bf := message.Message{ID: message.MsgBitfield, Payload: have}
+		buf = append(buf, bf.Serialize()...)
+	}
+	_, err := conn.Write(buf)
+	conn.SetDeadline(time.Time{}) // reset deadline
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+	addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	var p peer.Peer
+	if addr != nil {
+		p = peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+
+	return newClient(conn, nil, nil, p, remote.InfoHash, peerID), nil
+}
+
+// remote peer of the connection
+func (c *Client) Peer() peer.Peer {
+	return c.peer
 }
 
-// read and consume message from conn
-func (c *Client) Read() (*message.Message, error) {
-	return message.Read(c.Conn)
+// send choke message to peer (ID: 0)
+func (c *Client) SendChoke() error {
+	return c.send(&message.Message{ID: message.MsgChoke})
 }
 
 // send unchoke message to peer (ID: 1)
 func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgUnchoke})
 }
 
 // send interested message to peer (ID: 2)
 func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgInterested})
 }
 
 // send notinterested message to peer (ID: 3)
 func (c *Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgNotInterested})
 }
 
 // send have message to peer (ID: 4)
-func (c *Client) SendHave() error {
-	msg := message.Message{ID: message.MsgHave}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+func (c *Client) SendHave(idx int) error {
+	msg := message.FormatHave(idx)
+	return c.send(&msg)
+}
+
+// like SendHave but doesn't wait, a peer whose send queue is full is
+// disconnected with ErrSlowPeer. For announcing to peers other than the
+// one the caller serves
+func (c *Client) TrySendHave(idx int) error {
+	msg := message.FormatHave(idx)
+	return c.trySend(&msg, nil)
+}
+
+// send bitfield message to peer (ID: 5), only valid as the first message
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	return c.send(&message.Message{ID: message.MsgBitfield, Payload: bf})
 }
 
 // send request message to peer (ID: 6)
 func (c *Client) SendRequest(idx, begin, length int) error {
 	req := message.FormatRequest(idx, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+	return c.send(&req)
+}
+
+// send piece message to peer (ID: 7)
+func (c *Client) SendPiece(idx, begin int, block []byte) error {
+	msg := message.FormatPiece(idx, begin, block)
+	return c.send(&msg)
+}
+
+// like SendPiece but doesn't wait, a peer whose send queue is full is
+// disconnected with ErrSlowPeer. sent is called once the block was written
+// to the connection, it isn't if the connection stops first
+func (c *Client) TrySendPiece(idx, begin int, block []byte, sent func()) error {
+	msg := message.FormatPiece(idx, begin, block)
+	return c.trySend(&msg, sent)
 }
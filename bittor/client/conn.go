@@ -0,0 +1,208 @@
+package client
+
+import (
+	"bittor/bitfield"
+	"bittor/message"
+	"bittor/peer"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// a keep-alive is sent when nothing else was written for this long
+	KeepAliveInterval = 2 * time.Minute
+	// peers that send nothing, not even keep-alives, for this long are dropped
+	IdleTimeout = KeepAliveInterval + time.Minute
+
+	// messages buffered between the connection and the client user
+	readQueueSize  = 32
+	writeQueueSize = 64
+)
+
+var (
+	ErrClosed = errors.New("client closed")
+	// a peer that lets the send queue fill up isn't reading what we send
+	ErrSlowPeer = errors.New("peer not reading, send queue full")
+)
+
+// a serialized message waiting for the writer loop
+type queued struct {
+	buf []byte
+	// called once buf was written, may be nil
+	sent func()
+}
+
+// wraps an established connection and starts its reader and writer loops.
+// first is a message read during the handshake, delivered before the rest
+func newClient(conn net.Conn, bf bitfield.Bitfield, first *message.Message, p peer.Peer, infoHash, peerID [20]byte) *Client {
+	c := &Client{
+		Conn:     conn,
+		Choked:   true,
+		Bitfield: bf,
+		peer:     p,
+		infoHash: infoHash,
+		peerID:   peerID,
+		msgs:     make(chan *message.Message, readQueueSize),
+		out:      make(chan queued, writeQueueSize),
+		done:     make(chan struct{}),
+	}
+	if first != nil {
+		c.msgs <- first
+	}
+	go c.readLoop()
+	go c.writeLoop()
+	return c
+}
+
+// Close shuts the connection and stops both loops, safe to call more than once
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.setErr(ErrClosed)
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// Done is closed once the connection stops, Err tells why
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that stopped the connection, nil while it is open
+func (c *Client) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// keeps the first error, later ones are a consequence of it
+func (c *Client) setErr(err error) {
+	c.errMu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errMu.Unlock()
+}
+
+// fails the connection with err
+func (c *Client) fail(err error) {
+	c.setErr(err)
+	c.Close()
+}
+
+// Messages returns the channel of received messages. It is closed once the
+// connection stops, Err tells why
+func (c *Client) Messages() <-chan *message.Message {
+	return c.msgs
+}
+
+// Read waits for the next message. A timeout error implementing net.Error
+// is returned once deadline passes, a zero deadline waits indefinitely
+func (c *Client) Read(deadline time.Time) (*message.Message, error) {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			return nil, c.Err()
+		}
+		return msg, nil
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// reads messages until the connection fails or stays silent past IdleTimeout
+func (c *Client) readLoop() {
+	defer close(c.msgs)
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+		msg, err := message.Read(c.Conn)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				err = fmt.Errorf("peer idle for %v", IdleTimeout)
+			}
+			c.fail(err)
+			return
+		}
+		// keep-alive only resets the idle deadline
+		if msg == nil {
+			continue
+		}
+
+		select {
+		case c.msgs <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// writes queued messages and a keep-alive whenever the connection was quiet
+// for KeepAliveInterval
+func (c *Client) writeLoop() {
+	keepAlive := time.NewTimer(KeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		var q queued
+		select {
+		case <-c.done:
+			return
+		case q = <-c.out:
+		case <-keepAlive.C:
+			// zero length prefix
+			q.buf = make([]byte, 4)
+		}
+
+		// a peer that stops reading would otherwise block us forever
+		c.Conn.SetWriteDeadline(time.Now().Add(IdleTimeout))
+		if _, err := c.Conn.Write(q.buf); err != nil {
+			c.fail(err)
+			return
+		}
+		if q.sent != nil {
+			q.sent()
+		}
+		keepAlive.Reset(KeepAliveInterval)
+	}
+}
+
+// queues msg for the writer loop, waiting for room
+func (c *Client) send(msg *message.Message) error {
+	q := queued{buf: msg.Serialize()}
+	select {
+	case c.out <- q:
+		return nil
+	case <-c.done:
+		return c.Err()
+	}
+}
+
+// queues msg without waiting, for senders that must not stall on one peer.
+// The connection fails with ErrSlowPeer when the queue is full
+func (c *Client) trySend(msg *message.Message, sent func()) error {
+	q := queued{buf: msg.Serialize(), sent: sent}
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	select {
+	case c.out <- q:
+		return nil
+	default:
+		c.fail(ErrSlowPeer)
+		return ErrSlowPeer
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"bittor/message"
+	"bittor/peer"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func pipeClient(t *testing.T) (*Client, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	c := newClient(local, nil, nil, peer.Peer{}, [20]byte{}, [20]byte{})
+	t.Cleanup(func() {
+		c.Close()
+		remote.Close()
+	})
+	return c, remote
+}
+
+// a peer that stops reading is dropped instead of blocking the sender
+func TestTrySendHaveSlowPeer(t *testing.T) {
+	c, _ := pipeClient(t)
+
+	done := make(chan error, 1)
+	go func() {
+		// the writer holds one message, the queue the rest
+		for i := range writeQueueSize + 2 {
+			if err := c.TrySendHave(i); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrSlowPeer) {
+			t.Fatalf("got %v, want %v", err, ErrSlowPeer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TrySendHave blocked")
+	}
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("connection still open")
+	}
+	if !errors.Is(c.Err(), ErrSlowPeer) {
+		t.Fatalf("connection stopped with %v", c.Err())
+	}
+}
+
+func TestTrySendPieceSent(t *testing.T) {
+	c, remote := pipeClient(t)
+
+	sent := make(chan struct{})
+	if err := c.TrySendPiece(3, 16, []byte("block"), func() { close(sent) }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sent:
+		t.Fatal("sent before the peer read the block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	msg, err := message.Read(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != message.MsgPiece || string(msg.Payload[8:]) != "block" {
+		t.Fatalf("peer read %v", msg)
+	}
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("sent not called after the block was written")
+	}
+}
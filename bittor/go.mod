@@ -1,5 +1,3 @@
 module bittor
 
 go 1.25.0
-
-require github.com/jackpal/bencode-go v1.0.2
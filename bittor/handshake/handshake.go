@@ -27,12 +27,12 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 
 	curr := 1
-	curr = copy(buf[curr:], h.Pstr)
+	curr += copy(buf[curr:], h.Pstr)
 	// update if you want to extend
 	// https://www.bittorrent.org/beps/bep_0010.html
-	curr = copy(buf[curr:], make([]byte, 8))
-	curr = copy(buf[curr:], h.InfoHash[:])
-	curr = copy(buf[curr:], h.PeerID[:])
+	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.InfoHash[:])
+	copy(buf[curr:], h.PeerID[:])
 
 	return buf
 }
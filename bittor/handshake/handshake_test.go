@@ -0,0 +1,32 @@
+package handshake
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSerialize(t *testing.T) {
+	var infoHash, peerID [20]byte
+	copy(infoHash[:], "infohashinfohashinfo")
+	copy(peerID[:], "-BT0001-abcdefghijkl")
+	h := New(infoHash, peerID)
+
+	var want []byte
+	want = append(want, 19)
+	want = append(want, "BitTorrent protocol"...)
+	want = append(want, make([]byte, 8)...)
+	want = append(want, infoHash[:]...)
+	want = append(want, peerID[:]...)
+	got := h.Serialize()
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Serialize() = %q, want %q", got, want)
+	}
+
+	back, err := Read(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *back != h {
+		t.Fatalf("read back %+v, want %+v", back, h)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bittor/torfile"
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// prints torrent metadata and live swarm counts from every tracker
+func info(path string) error {
+	tf, err := torfile.Read(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("name:         %s\n", tf.Name)
+	fmt.Printf("info hash:    %x\n", tf.InfoHash)
+	fmt.Printf("size:         %d bytes\n", tf.Length)
+	fmt.Printf("pieces:       %d x %d bytes\n", len(tf.PieceHashes), tf.PieceLength)
+	fmt.Printf("private:      %t\n", tf.Private)
+
+	fmt.Printf("files:        %d\n", len(tf.Files))
+	for _, f := range tf.Files {
+		fmt.Printf("  %12d  %s\n", f.Length, f.Path)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	results, errs := tf.Scrape(ctx)
+
+	fmt.Printf("trackers:     %d\n", len(results))
+	w := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  TRACKER\tSEEDERS\tLEECHERS\tCOMPLETED\tERROR")
+	for i, tracker := range tf.Trackers() {
+		if errs[i] != nil {
+			fmt.Fprintf(w, "  %s\t-\t-\t-\t%v\n", tracker, errs[i])
+			continue
+		}
+		r := results[i]
+		fmt.Fprintf(w, "  %s\t%d\t%d\t%d\t-\n", tracker, r.Seeders, r.Leechers, r.Completed)
+	}
+	return w.Flush()
+}
@@ -4,21 +4,216 @@
 package main
 
 import (
+	"bittor/p2p"
+	"bittor/peer"
+	"bittor/portmap"
+	"bittor/storage"
 	"bittor/torfile"
+	"bittor/tui"
+	"bittor/verify"
+	"bittor/wire"
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
+	"time"
 )
 
+const usage = `usage:
+  bittor [-port n] [-nat] [-mmap] [-record dir] [-tui] <torrent> <out>
+                            download a single torrent, <out> is a file or
+                            for multi file torrents a directory
+  bittor serve [flags]      run a multi torrent session with a control API,
+                            optionally fed from a watch folder
+  bittor info <torrent>     print torrent metadata and tracker swarm counts
+  bittor seed [flags] <torrent> <path>
+                            upload complete data, optionally superseeding
+  bittor verify [flags] <torrent> <path>
+                            hash existing data and report complete pieces and files
+  bittor wire <recording>   print a recorded peer connection`
+
 func main() {
-	inPath, outPath := os.Args[1], os.Args[2]
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "serve":
+		if err := serve(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "seed":
+		if err := seedCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "verify":
+		if err := verifyCmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "wire":
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := dumpWire(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+	case "info":
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := info(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		fs := flag.NewFlagSet("bittor", flag.ExitOnError)
+		fs.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+		port := fs.Uint("port", 0, "peer listen port, first free port from 6881 to 6889 when 0")
+		nat := fs.Bool("nat", false, "forward the listen port with NAT-PMP or UPnP")
+		mmap := fs.Bool("mmap", false, "write the output through a memory mapping instead of a write cache, single file torrents only")
+		record := fs.String("record", "", "directory to record peer wire traffic to, one file per connection")
+		view := fs.Bool("tui", false, "show progress, pieces and peers in a terminal view")
+		fs.Parse(os.Args[1:])
+		if fs.NArg() < 2 || *port > 65535 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		err := download(fs.Arg(0), fs.Arg(1), downloadOpts{port: uint16(*port), nat: *nat, mmap: *mmap, record: *record, tui: *view})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+type downloadOpts struct {
+	port   uint16
+	nat    bool
+	mmap   bool
+	record string
+	tui    bool
+}
+
+// opens the peer listener, forwarding it on the gateway with nat. Returns
+// the port to announce and a function closing both
+func listenPeers(ctx context.Context, port uint16, nat bool) (net.Listener, uint16, func(), error) {
+	ln, err := portmap.Listen(port)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	port = portmap.ListenPort(ln)
+	log.Printf("listening for peers on %d", port)
+	if !nat {
+		return ln, port, func() { ln.Close() }, nil
+	}
+
+	// announce the forwarded port, the gateway may not grant the one we listen on
+	m, err := portmap.Map(ctx, portmap.Config{}, port)
+	if err != nil {
+		log.Printf("port mapping failed: %v", err)
+		return ln, port, func() { ln.Close() }, nil
+	}
+	log.Printf("port mapped: %s", m)
+	return ln, m.ExternalPort(), func() {
+		m.Close()
+		ln.Close()
+	}, nil
+}
+
+func download(inPath, outPath string, opts downloadOpts) error {
 	log.Println("in path:", inPath, "out path:", outPath)
 
 	tf, err := torfile.Read(inPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	// the mapping covers one contiguous file
+	if opts.mmap && len(tf.Files) > 1 {
+		return fmt.Errorf("-mmap only works for single file torrents, %s has %d files", tf.Name, len(tf.Files))
+	}
+
+	// Ctrl-C stops the download, verified pieces stay on disk
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ln, port, closeLn, err := listenPeers(ctx, opts.port, opts.nat)
+	if err != nil {
+		return err
+	}
+	defer closeLn()
+
+	tor, err := tf.NewTorrent(ctx, peer.NewID(), port)
+	if err != nil {
+		return err
+	}
+	if opts.tui {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		// runs after the download returns, so errors print below the view
+		defer startView(ctx, cancel, &tf, tor)()
+	}
+	if opts.record != "" {
+		if tor.Recorder, err = wire.NewRecorder(opts.record); err != nil {
+			return err
+		}
+	}
+	go tor.Serve(ctx, ln)
+
+	// pick up pieces an earlier run already wrote
+	rep, err := verify.Resume(ctx, &tf, tor, outPath)
+	if err != nil {
+		return err
+	}
+	if rep != nil {
+		log.Printf("resuming with %d/%d pieces already verified", rep.Complete, rep.Pieces)
+	}
+
+	if opts.mmap {
+		st, err := storage.OpenMmap(outPath, tf.Layout())
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+		tor.Storage = st
+	}
+
+	return tf.DownloadTo(ctx, tor, outPath, port)
+}
+
+// takes over the terminal with a live view of tor, q cancels the download.
+// Logging goes to the view meanwhile. Returns a function that stops the
+// view and hands the terminal back
+func startView(ctx context.Context, cancel context.CancelFunc, tf *torfile.File, tor *p2p.Torrent) func() {
+	logs := tui.NewLogBuffer(100)
+	log.SetOutput(logs)
+
+	v := tui.New(tor, os.Stdout, os.Stdin)
+	v.Log = logs
+	// the first announce came back before the view, later ones update it
+	host := ""
+	if u, err := url.Parse(tf.Announce); err == nil {
+		host = u.Host
+	}
+	v.SetTracker(tui.Tracker{Host: host, Announced: time.Now(), Peers: len(tor.Peers)})
+	tf.OnAnnounce = func(res torfile.AnnounceResult) {
+		v.SetTracker(tui.Tracker{Host: host, Announced: res.Time, Peers: len(res.Peers), Err: res.Err})
 	}
 
-	if err = tf.Download(outPath); err != nil {
-		log.Fatal(err)
+	vctx, stopView := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.Run(vctx, tui.DefaultInterval, cancel)
+	}()
+	return func() {
+		stopView()
+		<-done
+		log.SetOutput(os.Stderr)
 	}
 }
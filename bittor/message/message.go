@@ -50,19 +50,42 @@ type Message struct {
 func FormatRequest(idx, begin, length int) Message {
 	// 4 byte idx + 4 byte begin + 4 byte length
 	payload := make([]byte, 12)
-	binary.BigEndian.AppendUint32(payload[:4], uint32(idx))
-	binary.BigEndian.AppendUint32(payload[4:8], uint32(begin))
-	binary.BigEndian.AppendUint32(payload[8:], uint32(length))
+	binary.BigEndian.PutUint32(payload[:4], uint32(idx))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:], uint32(length))
 	return Message{MsgRequest, payload}
 }
 
 // Creates Have Msg
 func FormatHave(idx int) Message {
 	payload := make([]byte, 4)
-	binary.BigEndian.AppendUint32(payload, uint32(idx))
+	binary.BigEndian.PutUint32(payload, uint32(idx))
 	return Message{MsgHave, payload}
 }
 
+// Creates Piece Msg carrying block at begin of piece idx
+func FormatPiece(idx, begin int, block []byte) Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[:4], uint32(idx))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return Message{MsgPiece, payload}
+}
+
+// parses Request or Cancel message, they share the same payload
+func ParseRequest(msg *Message) (idx, begin, length int, err error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("expected Request ID (%d) but got ID %v", MsgRequest, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12 but got length %d", len(msg.Payload))
+	}
+	idx = int(binary.BigEndian.Uint32(msg.Payload[:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:]))
+	return idx, begin, length, nil
+}
+
 // parse Piece message and copy payload to buf
 // returns copied length to buf or error
 func ParsePiece(idx int, buf []byte, msg *Message) (int, error) {
@@ -90,6 +113,19 @@ func ParsePiece(idx int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// parses Piece message header and returns piece index and block begin offset
+func ParsePieceHeader(msg *Message) (idx, begin int, err error) {
+	if msg.ID != MsgPiece {
+		return 0, 0, fmt.Errorf("expected Piece ID (%d) but got ID %v", MsgPiece, msg.ID)
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, fmt.Errorf("payload too short. %d < 8", len(msg.Payload))
+	}
+	idx = int(binary.BigEndian.Uint32(msg.Payload[:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return idx, begin, nil
+}
+
 // parses Have message and return index
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
@@ -112,7 +148,7 @@ func (m *Message) Serialize() []byte {
 	len := uint32(len(m.Payload) + 1)
 	// 4 == length prefix
 	buf := make([]byte, 4+len)
-	binary.BigEndian.AppendUint32(buf[:4], len)
+	binary.BigEndian.PutUint32(buf[:4], len)
 	buf[4] = byte(m.ID)
 	copy(buf[5:], m.Payload)
 	return buf
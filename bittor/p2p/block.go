@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"net"
+	"time"
+)
+
+// a single request sized slice of a piece
+type block struct {
+	begin  int
+	length int
+	// when the block was requested, zero while unassigned
+	sent time.Time
+	done bool
+	// peer that delivered the block
+	peer net.IP
+}
+
+// splits piece of length into MaxBlockSize blocks
+func splitBlocks(length int) []block {
+	blocks := make([]block, 0, (length+MaxBlockSize-1)/MaxBlockSize)
+	for begin := 0; begin < length; begin += MaxBlockSize {
+		blocks = append(blocks, block{begin: begin, length: min(MaxBlockSize, length-begin)})
+	}
+	return blocks
+}
+
+// returns next block that is neither downloaded nor requested
+func (pw *pieceWork) nextBlock() *block {
+	for i := range pw.blocks {
+		if b := &pw.blocks[i]; !b.done && b.sent.IsZero() {
+			return b
+		}
+	}
+	return nil
+}
+
+// returns block starting at begin
+func (pw *pieceWork) blockAt(begin int) *block {
+	idx := begin / MaxBlockSize
+	if begin%MaxBlockSize != 0 || idx < 0 || idx >= len(pw.blocks) {
+		return nil
+	}
+	return &pw.blocks[idx]
+}
+
+// returns oldest outstanding request time or zero if nothing is in flight
+func (pw *pieceWork) oldestRequest() time.Time {
+	var oldest time.Time
+	for _, b := range pw.blocks {
+		if b.done || b.sent.IsZero() {
+			continue
+		}
+		if oldest.IsZero() || b.sent.Before(oldest) {
+			oldest = b.sent
+		}
+	}
+	return oldest
+}
+
+func (pw *pieceWork) complete() bool {
+	for _, b := range pw.blocks {
+		if !b.done {
+			return false
+		}
+	}
+	return true
+}
+
+// unassigns outstanding requests so another peer can pick them up,
+// downloaded blocks are kept
+func (pw *pieceWork) release() {
+	for i := range pw.blocks {
+		if !pw.blocks[i].done {
+			pw.blocks[i].sent = time.Time{}
+		}
+	}
+}
+
+// drops all downloaded data, used when the piece failed integrity check
+func (pw *pieceWork) reset() {
+	for i := range pw.blocks {
+		pw.blocks[i] = block{begin: pw.blocks[i].begin, length: pw.blocks[i].length}
+	}
+}
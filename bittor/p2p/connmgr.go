@@ -0,0 +1,280 @@
+package p2p
+
+import (
+	"bittor/client"
+	"bittor/peer"
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// default cap on connected peers per torrent
+	DefaultMaxPeers = 50
+	// default cap on dials that haven't completed a handshake yet
+	DefaultMaxHalfOpen = 8
+
+	// how often the manager looks for free slots without being woken
+	connManagerInterval = time.Second
+	// retry backoff for peers that failed or dropped
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 5 * time.Minute
+	// consecutive failures before a peer is forgotten
+	maxPeerFailures = 6
+)
+
+// what we know about a peer across connections
+type peerRecord struct {
+	peer      peer.Peer
+	connected bool
+	dialing   bool
+	failures  int
+	retryAt   time.Time
+	// connected to us from an ephemeral port nobody listens on, never
+	// dialed and forgotten once the connection ends
+	inbound bool
+	// verified bytes received and time spent connected, over all connections
+	downloaded int
+	uptime     time.Duration
+}
+
+// bytes per second this peer delivered so far. Peers never connected score
+// as if they were average so they get tried before known slow ones
+func (pr *peerRecord) score(avg float64) float64 {
+	if pr.uptime < time.Second {
+		return avg
+	}
+	return float64(pr.downloaded) / pr.uptime.Seconds()
+}
+
+// connManager keeps a torrent's connections topped up from the known peer pool
+type connManager struct {
+	t           *Torrent
+	maxPeers    int
+	maxHalfOpen int
+
+	mu       sync.Mutex
+	known    map[string]*peerRecord
+	conns    int
+	halfOpen int
+	// signalled when a slot frees or peers are added
+	wake chan struct{}
+}
+
+func newConnManager(t *Torrent) *connManager {
+	m := &connManager{
+		t:           t,
+		maxPeers:    t.MaxPeers,
+		maxHalfOpen: t.MaxHalfOpen,
+		known:       map[string]*peerRecord{},
+		wake:        make(chan struct{}, 1),
+	}
+	if m.maxPeers <= 0 {
+		m.maxPeers = DefaultMaxPeers
+	}
+	if m.maxHalfOpen <= 0 {
+		m.maxHalfOpen = DefaultMaxHalfOpen
+	}
+	return m
+}
+
+// adds peers to the known pool, already known peers are left untouched
+func (m *connManager) add(peers []peer.Peer) {
+	m.mu.Lock()
+	for _, p := range peers {
+		key := p.String()
+		if pr, ok := m.known[key]; ok {
+			// the peer listens there after all
+			pr.inbound = false
+			continue
+		}
+		m.known[key] = &peerRecord{peer: p}
+	}
+	m.mu.Unlock()
+	m.signal()
+}
+
+func (m *connManager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dials peers whenever slots are free until ctx is done. Workers are
+// tracked in wg so Download can wait for them
+func (m *connManager) run(ctx context.Context, wg *sync.WaitGroup, workQueue chan *pieceWork, results chan *pieceResult) {
+	tick := time.NewTicker(connManagerInterval)
+	defer tick.Stop()
+
+	for {
+		for _, pr := range m.candidates() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.dial(ctx, pr, workQueue, results)
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// picks peers to dial for the free slots, best performers first.
+// Candidates are marked dialing and hold a Limiter slot
+func (m *connManager) candidates() []*peerRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	free := min(m.maxPeers-m.conns-m.halfOpen, m.maxHalfOpen-m.halfOpen)
+	if free <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var pool []*peerRecord
+	var total float64
+	var measured int
+	for _, pr := range m.known {
+		if pr.uptime >= time.Second {
+			total += pr.score(0)
+			measured++
+		}
+		if pr.inbound || pr.connected || pr.dialing || now.Before(pr.retryAt) || m.t.Bans.Banned(pr.peer.IP) {
+			continue
+		}
+		pool = append(pool, pr)
+	}
+	avg := 0.0
+	if measured > 0 {
+		avg = total / float64(measured)
+	}
+	sort.Slice(pool, func(i, j int) bool {
+		if si, sj := pool[i].score(avg), pool[j].score(avg); si != sj {
+			return si > sj
+		}
+		return pool[i].failures < pool[j].failures
+	})
+
+	var picked []*peerRecord
+	for _, pr := range pool {
+		if len(picked) == free || !m.t.Limiter.TryAcquire() {
+			break
+		}
+		pr.dialing = true
+		m.halfOpen++
+		picked = append(picked, pr)
+	}
+	return picked
+}
+
+func (m *connManager) dial(ctx context.Context, pr *peerRecord, workQueue chan *pieceWork, results chan *pieceResult) {
+	defer m.t.Limiter.Release()
+
+	conn, err := client.Dial(ctx, pr.peer)
+	var c *client.Client
+	if err == nil {
+		c, err = client.Handshake(ctx, m.t.Recorder.Wrap(conn, nil), pr.peer, m.t.PeerID, m.t.InfoHash)
+	}
+
+	m.mu.Lock()
+	pr.dialing = false
+	m.halfOpen--
+	if err != nil {
+		m.failed(pr)
+		m.mu.Unlock()
+		m.signal()
+		if ctx.Err() == nil {
+			log.Printf("could not handshake with %s. error: %v. disconnecting\n", pr.peer.IP, err)
+		}
+		return
+	}
+	pr.connected = true
+	m.conns++
+	m.mu.Unlock()
+
+	log.Printf("completed handshake with peer %s", pr.peer.IP)
+	// the accepting side sent its bitfield already, ours follows
+	if bf := m.t.Bitfield(); bf != nil {
+		c.SendBitfield(bf)
+	}
+	m.serve(ctx, pr, c, workQueue, results)
+}
+
+// runs the worker for an established connection and records how it went
+func (m *connManager) serve(ctx context.Context, pr *peerRecord, c *client.Client, workQueue chan *pieceWork, results chan *pieceResult) {
+	start := time.Now()
+	downloaded := m.t.runWorker(ctx, c, workQueue, results)
+
+	m.mu.Lock()
+	pr.connected = false
+	pr.downloaded += downloaded
+	pr.uptime += time.Since(start)
+	m.conns--
+	switch {
+	case pr.inbound:
+		delete(m.known, pr.peer.String())
+	case ctx.Err() != nil:
+	case downloaded > 0:
+		// useful peer, let it back in soon
+		pr.failures = 0
+		pr.retryAt = time.Now().Add(minRetryDelay)
+	default:
+		m.failed(pr)
+	}
+	m.mu.Unlock()
+
+	// a slot freed up, replace the connection
+	m.signal()
+}
+
+// backs off or forgets a peer, caller holds m.mu
+func (m *connManager) failed(pr *peerRecord) {
+	pr.failures++
+	if pr.failures >= maxPeerFailures {
+		delete(m.known, pr.peer.String())
+		return
+	}
+	delay := minRetryDelay << (pr.failures - 1)
+	pr.retryAt = time.Now().Add(min(delay, maxRetryDelay))
+}
+
+// reserves a slot for a connection a remote peer opened
+func (m *connManager) accept(p peer.Peer) (*peerRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns+m.halfOpen >= m.maxPeers {
+		return nil, false
+	}
+	key := p.String()
+	pr, ok := m.known[key]
+	if !ok {
+		pr = &peerRecord{peer: p, inbound: true}
+		m.known[key] = pr
+	}
+	if pr.connected {
+		return nil, false
+	}
+	pr.connected = true
+	m.conns++
+	return pr, true
+}
+
+// releases a slot reserved by accept, for a connection that was never used
+// or only uploaded to
+func (m *connManager) unaccept(pr *peerRecord) {
+	m.mu.Lock()
+	pr.connected = false
+	m.conns--
+	if pr.inbound {
+		delete(m.known, pr.peer.String())
+	}
+	m.mu.Unlock()
+}
@@ -0,0 +1,42 @@
+package p2p
+
+import (
+	"bittor/peer"
+	"net"
+	"testing"
+)
+
+func TestConnManagerInboundNotDialed(t *testing.T) {
+	m := newConnManager(&Torrent{})
+	tracked := peer.Peer{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	inbound := peer.Peer{IP: net.ParseIP("10.0.0.2"), Port: 51234}
+	m.add([]peer.Peer{tracked})
+
+	pr, ok := m.accept(inbound)
+	if !ok {
+		t.Fatal("no slot for an inbound peer")
+	}
+	m.unaccept(pr)
+	if _, ok := m.known[inbound.String()]; ok {
+		t.Fatal("inbound peer kept in the pool after disconnecting")
+	}
+
+	// an inbound peer while connected, and one the tracker lists as well
+	if _, ok := m.accept(inbound); !ok {
+		t.Fatal("no slot for an inbound peer")
+	}
+	listening := peer.Peer{IP: net.ParseIP("10.0.0.3"), Port: 6881}
+	pr, _ = m.accept(listening)
+	m.unaccept(pr)
+	pr, _ = m.accept(listening)
+	m.add([]peer.Peer{listening})
+	m.unaccept(pr)
+
+	picked := map[string]bool{}
+	for _, pr := range m.candidates() {
+		picked[pr.peer.String()] = true
+	}
+	if len(picked) != 2 || !picked[tracked.String()] || !picked[listening.String()] {
+		t.Fatalf("dialing %v, want %s and %s", picked, tracked, listening)
+	}
+}
@@ -0,0 +1,96 @@
+package p2p_test
+
+import (
+	"bittor/ban"
+	"bittor/storage"
+	"bittor/swarmtest"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testLength      = 512 << 10
+	testPieceLength = 32 << 10
+)
+
+func TestDownloadSwarm(t *testing.T) {
+	slow := swarmtest.SeederConfig{Behavior: swarmtest.Slow, Delay: 20 * time.Millisecond}
+	tests := []struct {
+		name    string
+		seeders []swarmtest.SeederConfig
+		// written through a file storage instead of assembled in memory
+		toFile bool
+	}{
+		{name: "slow", seeders: []swarmtest.SeederConfig{slow, slow}},
+		{name: "choking", seeders: []swarmtest.SeederConfig{{Behavior: swarmtest.Choking}, {}}},
+		// faster than the honest seeder so it gets pieces to fail
+		{name: "corrupt", seeders: []swarmtest.SeederConfig{{Behavior: swarmtest.Corrupt}, slow}},
+		{name: "mixed", seeders: []swarmtest.SeederConfig{{Behavior: swarmtest.Corrupt}, {Behavior: swarmtest.Choking}, slow, {}}},
+		{name: "mixed to file", seeders: []swarmtest.SeederConfig{{Behavior: swarmtest.Corrupt}, {Behavior: swarmtest.Choking}, slow, {}}, toFile: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := swarmtest.New(swarmtest.Data(testLength, 1), testPieceLength, tt.seeders...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			tor, err := s.Torrent(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tor.Bans = ban.New(2)
+
+			var path string
+			if tt.toFile {
+				path = filepath.Join(t.TempDir(), "swarmtest.bin")
+				st, err := storage.OpenFiles(s.File.Spans(path), s.File.Layout())
+				if err != nil {
+					t.Fatal(err)
+				}
+				tor.Storage = storage.NewCache(st, s.File.Layout(), 0)
+			}
+
+			got, err := tor.Download(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.toFile {
+				if err := tor.Storage.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if got, err = os.ReadFile(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, s.Data) {
+				t.Fatal("downloaded data differs from the payload")
+			}
+
+			for _, sd := range s.Seeders {
+				switch sd.Config.Behavior {
+				case swarmtest.Corrupt:
+					if !tor.Bans.Banned(sd.Peer.IP) {
+						t.Errorf("corrupt seeder %s not banned, %d strikes", sd.Peer, tor.Bans.Strikes(sd.Peer.IP))
+					}
+				case swarmtest.Choking:
+					if sd.Uploaded() != 0 {
+						t.Errorf("choking seeder %s uploaded %d bytes", sd.Peer, sd.Uploaded())
+					}
+				default:
+					if tor.Bans.Banned(sd.Peer.IP) {
+						t.Errorf("%s seeder %s banned", sd.Config.Behavior, sd.Peer)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+)
+
+type EventType uint8
+
+const (
+	// a piece passed its integrity check
+	EventPieceVerified EventType = iota
+	// handshake with a peer completed
+	EventPeerConnected
+	// a peer connection was closed
+	EventPeerDisconnected
+	// a downloaded piece did not match its hash
+	EventHashFailed
+	// periodic download rate sample
+	EventRate
+	// all pieces verified
+	EventCompleted
+)
+
+// how often rate samples are taken while downloading
+const rateInterval = time.Second
+
+func (et EventType) String() string {
+	switch et {
+	case EventPieceVerified:
+		return "PieceVerified"
+	case EventPeerConnected:
+		return "PeerConnected"
+	case EventPeerDisconnected:
+		return "PeerDisconnected"
+	case EventHashFailed:
+		return "HashFailed"
+	case EventRate:
+		return "Rate"
+	case EventCompleted:
+		return "Completed"
+	default:
+		return fmt.Sprintf("Unknown%d", et)
+	}
+}
+
+// Event describes something that happened during a download.
+// Only the fields relevant to Type are set
+type Event struct {
+	Type EventType
+	Time time.Time
+	// piece index for piece events
+	Piece int
+	// remote address for peer and hash events
+	Peer string
+	// bytes per second for rate samples
+	Rate float64
+	// reason a peer disconnected
+	Err error
+}
+
+// Stats is a snapshot of a download's progress
+type Stats struct {
+	Pieces     int
+	Done       int
+	Length     int
+	Downloaded int
+	// block bytes sent to peers
+	Uploaded int
+	// currently connected peers
+	Peers        int
+	HashFailures int
+	// bytes per second over the last sample interval
+	Rate       float64
+	UploadRate float64
+	Started    time.Time
+	Complete   bool
+}
+
+// ETA estimates the time left at the current rate, 0 when complete and
+// negative while nothing is coming in
+func (s Stats) ETA() time.Duration {
+	if s.Complete {
+		return 0
+	}
+	if s.Rate <= 0 {
+		return -1
+	}
+	return time.Duration(float64(s.Length-s.Downloaded) / s.Rate * float64(time.Second))
+}
+
+// Subscribe returns a channel receiving download events and a function that
+// cancels the subscription. Events are dropped rather than stalling the
+// download when the channel buffer is full
+func (t *Torrent) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	t.mu.Lock()
+	if t.subs == nil {
+		t.subs = map[chan Event]struct{}{}
+	}
+	t.subs[ch] = struct{}{}
+	t.mu.Unlock()
+
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.subs[ch]; ok {
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (t *Torrent) emit(ev Event) {
+	ev.Time = time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ch := range t.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Stats returns a snapshot of the download progress
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := Stats{
+		Pieces:       len(t.PieceHashes),
+		Length:       t.Length,
+		Peers:        len(t.clients),
+		HashFailures: t.hashFailures,
+		Rate:         t.rate,
+		UploadRate:   t.uploadRate,
+		Started:      t.started,
+		Uploaded:     int(t.uploaded.Load()),
+	}
+	for idx := range t.PieceHashes {
+		if t.have.HasPiece(idx) {
+			st.Done++
+			st.Downloaded += t.calculatePieceSize(idx)
+		}
+	}
+	st.Complete = st.Done == st.Pieces
+	return st
+}
+
+// samples transferred bytes into rates until done is closed
+func (t *Torrent) sampleRate(done <-chan struct{}) {
+	tick := time.NewTicker(rateInterval)
+	defer tick.Stop()
+
+	last, lastUploaded := time.Now(), t.uploaded.Load()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-tick.C:
+			elapsed := now.Sub(last)
+			rate := float64(t.received.Swap(0)) / elapsed.Seconds()
+			uploaded := t.uploaded.Load()
+			last = now
+
+			t.mu.Lock()
+			t.rate = rate
+			t.uploadRate = float64(uploaded-lastUploaded) / elapsed.Seconds()
+			for _, pc := range t.clients {
+				pc.sample(elapsed)
+			}
+			t.mu.Unlock()
+			lastUploaded = uploaded
+			t.emit(Event{Type: EventRate, Rate: rate})
+		}
+	}
+}
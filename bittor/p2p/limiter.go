@@ -0,0 +1,55 @@
+package p2p
+
+import "context"
+
+// Limiter caps the number of peer connections, it can be shared between
+// torrents so a whole session stays under one limit.
+// A nil Limiter never limits.
+type Limiter struct {
+	slots chan struct{}
+}
+
+func NewLimiter(max int) *Limiter {
+	return &Limiter{slots: make(chan struct{}, max)}
+}
+
+// blocks until a slot is free or ctx is done
+func (l *Limiter) Acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// takes a slot only if one is immediately available
+func (l *Limiter) TryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// number of slots in use
+func (l *Limiter) InUse() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
@@ -0,0 +1,48 @@
+package p2p
+
+import (
+	"bittor/client"
+	"bittor/handshake"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// Serve accepts incoming peers for this torrent on ln until ctx is done, for
+// a listener that isn't shared with other torrents
+func (t *Torrent) Serve(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("peer listener stopped: %v", err)
+			return err
+		}
+		go t.serveConn(conn)
+	}
+}
+
+func (t *Torrent) serveConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	hs, err := handshake.Read(conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil || hs.InfoHash != t.InfoHash {
+		conn.Close()
+		return
+	}
+
+	c, err := client.Accept(t.Recorder.Wrap(conn, hs), hs, t.PeerID, t.Bitfield())
+	if err != nil {
+		return
+	}
+	if !t.AddClient(c) {
+		c.Close()
+	}
+}
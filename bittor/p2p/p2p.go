@@ -1,26 +1,62 @@
 package p2p
 
 import (
+	"bittor/ban"
+	"bittor/bitfield"
 	"bittor/client"
 	"bittor/message"
 	"bittor/peer"
+	"bittor/storage"
+	"bittor/wire"
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"log"
-	"runtime"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	// largest number of bytes a request can ask for (16KB)
 	MaxBlockSize = 16384
-	// num of unfulfilled req a client can hasve in its pipeline
-	// can be fine tuned to increate download speed
-	//TODO: THIS CAN BE DYNAMICALLY SET
-	MaxBackLog = 5
+	// bounds for num of unfulfilled req a client can have in its pipeline,
+	// actual depth is sized per peer from its bandwidth-delay product
+	MinBackLog = 2
+	MaxBackLog = 128
+	// consecutive stalled pieces before a peer is dropped
+	maxStalls = 3
+	// how long a peer may keep us choked before the slot goes to another
+	maxChokeWait = 2 * time.Minute
 )
 
+var (
+	errStalled = errors.New("peer stalled")
+	errBanned  = errors.New("peer banned")
+	errChoked  = errors.New("peer keeps us choked")
+)
+
+// PartialError is returned when a download stops before every piece was verified
+type PartialError struct {
+	Done  int
+	Total int
+	// bytes of verified pieces
+	Downloaded int
+	Err        error
+}
+
+func (e *PartialError) Error() string {
+	percent := float64(e.Done) / float64(e.Total) * 100
+	return fmt.Sprintf("download stopped at %d/%d pieces (%0.2f%%): %v", e.Done, e.Total, percent, e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
 type Torrent struct {
 	Peers       []peer.Peer
 	PeerID      [20]byte
@@ -29,12 +65,78 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	// optional connection cap, shared when several torrents run at once
+	Limiter *Limiter
+	// optional ban list, peers sending corrupt data are added to it
+	Bans *ban.List
+	// caps on connected peers and in progress dials, defaults when 0
+	MaxPeers    int
+	MaxHalfOpen int
+	// when set verified pieces are written here as they arrive instead of
+	// being assembled in memory
+	Storage storage.Storage
+	// disk I/O goroutines, storage.DefaultIOWorkers when 0
+	IOWorkers int
+	// optional, records the wire traffic of every peer connection
+	Recorder *wire.Recorder
+	// peers unchoked at once by Seed, DefaultMaxUploads when 0
+	MaxUploads int
+	// Seed reveals pieces one at a time (BEP 16), for an initial seed.
+	// A peer that never passes its piece on gets nothing more
+	SuperSeed bool
+
+	mu sync.Mutex
+	// in memory payload when there's no Storage
+	mem *storage.Memory
+	// verified pieces kept between Download calls so a stopped download
+	// picks up where it left off
+	have bitfield.Bitfield
+	// connections accepted by a listener while Download or Seed runs
+	incoming chan incomingConn
+	conns    *connManager
+	// serves block reads for uploads while running
+	disk *storage.Pool
+	// set while Seed runs in superseeding mode
+	superSeed *superSeed
+
+	subs map[chan Event]struct{}
+	// connected peers
+	clients map[*client.Client]*peerConn
+	// workers downloading each piece
+	active       map[int]int
+	hashFailures int
+	rate         float64
+	uploadRate   float64
+	started      time.Time
+	// block bytes received since the last rate sample
+	received atomic.Int64
+	uploaded atomic.Int64
+}
+
+// connection accepted by a listener with the slot reserved for it
+type incomingConn struct {
+	client *client.Client
+	peer   *peerRecord
 }
 
 type pieceWork struct {
 	index  int
 	hash   [20]byte
 	length int
+	// partial download survives reassignment to another peer
+	buf    []byte
+	blocks []block
+	// blocks of the last copy that failed integrity check
+	failed []failedBlock
+}
+
+func newPieceWork(idx int, hash [20]byte, length int) *pieceWork {
+	return &pieceWork{
+		index:  idx,
+		hash:   hash,
+		length: length,
+		blocks: splitBlocks(length),
+	}
 }
 
 type pieceResult struct {
@@ -42,18 +144,26 @@ type pieceResult struct {
 	buf   []byte
 }
 
+// outcome of storing a verified piece, sum is its hash as read back
+type pieceWritten struct {
+	index int
+	sum   [20]byte
+	err   error
+}
+
 type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+	work     *pieceWork
+	client   *client.Client
+	conn     *peerConn
+	pipeline *pipeline
+	backlog  int
+	received *atomic.Int64
+	peerIP   net.IP
 }
 
 // reads message from client and updates state
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read()
+func (state *pieceProgress) readMessage(deadline time.Time) error {
+	msg, err := state.client.Read(deadline)
 	if err != nil {
 		return err
 	}
@@ -64,64 +174,108 @@ func (state *pieceProgress) readMessage() error {
 
 	switch msg.ID {
 	case message.MsgUnchoke:
-		state.client.Choked = false
+		state.conn.setChoked(false)
 	case message.MsgChoke:
-		state.client.Choked = true
+		state.conn.setChoked(true)
+		// choking discards all pending requests
+		state.work.release()
+		state.backlog = 0
 	case message.MsgHave:
 		idx, err := message.ParseHave(msg)
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.HasPiece(idx)
+		state.conn.have(idx)
+	case message.MsgBitfield, message.MsgInterested, message.MsgNotInterested, message.MsgRequest, message.MsgCancel:
+		return state.conn.up.handle(msg)
 	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
+		idx, begin, err := message.ParsePieceHeader(msg)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
+		b := state.work.blockAt(begin)
+		// late block for a piece we already gave up on or a duplicate
+		if idx != state.work.index || b == nil || b.done {
+			return nil
+		}
+		n, err := message.ParsePiece(state.work.index, state.work.buf, msg)
+		if err != nil {
+			return err
+		}
+		if n != b.length {
+			return fmt.Errorf("block %d of piece %d expected length %d got %d", begin, idx, b.length, n)
+		}
+		state.pipeline.observe(n, b.sent)
+		state.received.Add(int64(n))
+		state.conn.downloaded.Add(int64(n))
+		if !b.sent.IsZero() {
+			state.backlog--
+		}
+		b.done = true
+		b.peer = state.peerIP
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+// earliest point at which an outstanding request is considered stalled
+func (state *pieceProgress) deadline() time.Time {
+	oldest := state.work.oldestRequest()
+	if oldest.IsZero() {
+		// nothing in flight (choked), wait as long as we would for a fresh peer
+		return time.Now().Add(state.pipeline.timeout(0))
 	}
+	return oldest.Add(state.pipeline.timeout(state.backlog))
+}
 
-	// setting a deadline helps get unresponsive peer unstuck
-	// 30 seconds should be more then enough to download 262kb piece
-	//TODO: THIS CAN BE DYNAMICALLY SET
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
+func (t *Torrent) attemptDownloadPiece(pc *peerConn, pw *pieceWork, pl *pipeline) ([]byte, error) {
+	c := pc.c
+	state := pieceProgress{
+		work:     pw,
+		client:   c,
+		conn:     pc,
+		pipeline: pl,
+		received: &t.received,
+		peerIP:   c.Peer().IP,
+	}
+	// allocated lazily so queued work doesn't hold the whole torrent in memory
+	if pw.buf == nil {
+		pw.buf = make([]byte, pw.length)
+	}
 
-	for state.downloaded < pw.length {
-		if !state.client.Choked {
+	for !pw.complete() {
+		// nothing in flight and no way to ask, let another peer have the piece
+		if c.Choked && state.backlog == 0 {
+			pw.release()
+			return nil, errChoked
+		}
+		if !c.Choked {
 			// grouping for performance imrpovement
-			// batching request
-			for state.backlog < MaxBackLog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
+			// batching request up to the peer's bandwidth-delay product
+			for state.backlog < pl.depth() {
+				b := pw.nextBlock()
+				if b == nil {
+					break
 				}
-
-				if err := c.SendRequest(pw.index, state.requested, blockSize); err != nil {
+				if err := c.SendRequest(pw.index, b.begin, b.length); err != nil {
+					pw.release()
 					return nil, err
 				}
-
+				b.sent = time.Now()
 				state.backlog++
-				state.requested += blockSize
 			}
 		}
-	}
 
-	if err := state.readMessage(); err != nil {
-		return nil, err
+		// setting a deadline helps get unresponsive peer unstuck
+		if err := state.readMessage(state.deadline()); err != nil {
+			pw.release()
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, errStalled
+			}
+			return nil, err
+		}
 	}
 
-	return state.buf, nil
+	return pw.buf, nil
 }
 
 // checking byt comparing hash in the .torrent
@@ -133,42 +287,274 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peer.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
-	if err != nil {
-		log.Printf("could not handshake with %s. error: %v. disconnecting\n", peer.IP, err)
-		return
+// handles a message received while no piece is in progress
+func peerMessage(pc *peerConn, msg *message.Message) error {
+	if msg == nil {
+		return nil
+	}
+	switch msg.ID {
+	case message.MsgUnchoke:
+		pc.setChoked(false)
+	case message.MsgChoke:
+		pc.setChoked(true)
+	case message.MsgHave:
+		idx, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		pc.have(idx)
+	case message.MsgBitfield, message.MsgInterested, message.MsgNotInterested, message.MsgRequest, message.MsgCancel:
+		return pc.up.handle(msg)
 	}
-	defer c.Conn.Close()
-	log.Printf("completed handshake with peer %s", peer.IP)
+	return nil
+}
 
+// reads messages while the peer keeps us choked, tracking the pieces it
+// announces and serving its requests. Cancelling the download closes c
+// which ends the wait
+func waitUnchoke(pc *peerConn) error {
+	deadline := time.Now().Add(maxChokeWait)
+	for pc.c.Choked {
+		msg, err := pc.c.Read(deadline)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return errChoked
+			}
+			return err
+		}
+		if err := peerMessage(pc, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handles messages for d while the peer has nothing we need, so its new
+// pieces are seen and its requests served in the meantime
+func idle(pc *peerConn, d time.Duration) error {
+	deadline := time.Now().Add(d)
+	for {
+		msg, err := pc.c.Read(deadline)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+		if err := peerMessage(pc, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// downloads pieces from an established connection until it fails or ctx is
+// done, returns the bytes of verified pieces the peer delivered
+func (t *Torrent) runWorker(ctx context.Context, c *client.Client, workQueue chan *pieceWork, results chan *pieceResult) (downloaded int) {
+	addr := c.Conn.RemoteAddr().String()
+	pc := t.peerConnected(c)
+	// closing the connection unblocks a worker waiting on a read
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	var reason error
+	defer func() {
+		stop()
+		c.Close()
+		if ctx.Err() != nil {
+			reason = ctx.Err()
+		}
+		t.peerDisconnected(pc, reason)
+	}()
+
+	// every peer may download from us while we download
+	pc.up = newUploader(t, pc, nil, nil)
+	pc.up.unchoked = true
+	pc.amChoking.Store(false)
 	c.SendUnchoke()
 	c.SendInterested()
 
-	for pw := range workQueue {
-		// if doesn't have piece put the work back on the queue to retry
+	pl, stalls, misses := newPipeline(), 0, 0
+	for {
+		if t.Bans.Banned(c.Peer().IP) {
+			reason = errBanned
+			return
+		}
+
+		// work is only taken once the peer lets us request it
+		if err := waitUnchoke(pc); err != nil {
+			reason = err
+			return
+		}
+
+		var pw *pieceWork
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-c.Messages():
+			// every missing piece is taken by other workers
+			if !ok {
+				reason = c.Err()
+				return
+			}
+			if err := peerMessage(pc, msg); err != nil {
+				reason = err
+				return
+			}
+			continue
+		case pw = <-workQueue:
+		}
+
+		// if doesn't have piece put the work back on the queue for someone else
 		if !c.Bitfield.HasPiece(pw.index) {
 			workQueue <- pw
-			return
+			// went through the whole queue without a match, give the peer
+			// time to announce new pieces before cycling again
+			if misses++; misses > len(workQueue) {
+				misses = 0
+				if err := idle(pc, time.Second); err != nil {
+					reason = err
+					return
+				}
+			}
+			continue
 		}
+		misses = 0
 
-		buf, err := attemptDownloadPiece(c, pw)
+		t.setActive(pw.index, true)
+		buf, err := t.attemptDownloadPiece(pc, pw, pl)
+		t.setActive(pw.index, false)
+		if errors.Is(err, errChoked) {
+			workQueue <- pw
+			continue
+		}
+		// slow peer, hand its outstanding blocks to someone else
+		if errors.Is(err, errStalled) {
+			workQueue <- pw
+			pl.stalled()
+			if stalls++; stalls >= maxStalls {
+				log.Printf("peer %s stalled %d times. disconnecting\n", addr, stalls)
+				reason = err
+				return
+			}
+			continue
+		}
 		// when failed put the work back on the queue to retry
 		if err != nil {
 			log.Println("failed downloading", err)
 			workQueue <- pw
+			reason = err
 			return
 		}
+		stalls = 0
 
 		if err = checkIntegrity(pw, buf); err != nil {
 			log.Printf("piece %d failed integrity check\n", pw.index)
+			t.hashFailed(pw.index, addr)
+			t.attributeFailure(pw)
+			pw.reset()
 			workQueue <- pw
 			continue
 		}
+		t.confirmCulprits(pw)
+
+		// peers hear about the piece once it's stored, see broadcastHave
+		select {
+		case results <- &pieceResult{pw.index, buf}:
+			downloaded += len(buf)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// AddClient hands a connection accepted by a listener to a running download
+// or seed. Returns false when the torrent is not running or has no free slot, the
+// caller then keeps ownership of the connection
+func (t *Torrent) AddClient(c *client.Client) bool {
+	if t.Bans.Banned(c.Peer().IP) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.incoming == nil {
+		return false
+	}
+	pr, ok := t.conns.accept(c.Peer())
+	if !ok {
+		return false
+	}
+	if !t.Limiter.TryAcquire() {
+		t.conns.unaccept(pr)
+		return false
+	}
+	select {
+	case t.incoming <- incomingConn{c, pr}:
+		return true
+	default:
+		t.Limiter.Release()
+		t.conns.unaccept(pr)
+		return false
+	}
+}
+
+// SetHave marks pieces already present in Storage, e.g. from a previous run,
+// so Download skips them. Must be called before Download
+func (t *Torrent) SetHave(bf bitfield.Bitfield) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.have = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	copy(t.have, bf)
+}
 
-		c.SendHave()
-		results <- &pieceResult{pw.index, buf}
+// AddPeers adds peers, e.g. from a tracker re-announce, to the pool the
+// connection manager dials from
+func (t *Torrent) AddPeers(peers []peer.Peer) {
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = newConnManager(t)
 	}
+	conns := t.conns
+	t.mu.Unlock()
+	conns.add(peers)
+}
+
+func (t *Torrent) peerConnected(c *client.Client) *peerConn {
+	pc := newPeerConn(c)
+	pc.setBitfield(c.Bitfield, len(t.PieceHashes))
+	t.mu.Lock()
+	if t.clients == nil {
+		t.clients = map[*client.Client]*peerConn{}
+	}
+	t.clients[c] = pc
+	t.mu.Unlock()
+	t.emit(Event{Type: EventPeerConnected, Peer: pc.addr})
+	return pc
+}
+
+func (t *Torrent) peerDisconnected(pc *peerConn, reason error) {
+	t.mu.Lock()
+	delete(t.clients, pc.c)
+	t.mu.Unlock()
+	t.emit(Event{Type: EventPeerDisconnected, Peer: pc.addr, Err: reason})
+}
+
+// announces a stored piece to every connected peer so they can request it
+func (t *Torrent) broadcastHave(idx int) {
+	t.mu.Lock()
+	clients := make([]*client.Client, 0, len(t.clients))
+	for c := range t.clients {
+		clients = append(clients, c)
+	}
+	t.mu.Unlock()
+	// a peer not reading is dropped rather than holding up the download
+	for _, c := range clients {
+		c.TrySendHave(idx)
+	}
+}
+
+func (t *Torrent) hashFailed(idx int, addr string) {
+	t.mu.Lock()
+	t.hashFailures++
+	t.mu.Unlock()
+	t.emit(Event{Type: EventHashFailed, Piece: idx, Peer: addr})
 }
 
 func (t *Torrent) calculateBoundsForPiece(idx int) (begin, end int) {
@@ -185,36 +571,164 @@ func (t *Torrent) calculatePieceSize(idx int) int {
 	return end - begin
 }
 
-func (t *Torrent) Download() ([]byte, error) {
+// Download fetches every missing piece and returns the assembled data, or nil
+// when pieces are written to Storage. Writes go through a pool of I/O workers
+// so a slow disk doesn't hold up peers.
+// When ctx is cancelled every peer connection is closed before returning a
+// *PartialError. Verified pieces are kept and a later call resumes from them
+func (t *Torrent) Download(ctx context.Context) ([]byte, error) {
 	log.Printf("starting download for %s", t.Name)
 
-	// initialize work queue according to amount of piece hashes
+	// workers are waited on after they were cancelled so no connection
+	// outlives the download
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	totalPieces := len(t.PieceHashes)
+	incoming := make(chan incomingConn, 16)
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = newConnManager(t)
+	}
+	conns := t.conns
+	if t.have == nil {
+		t.have = make(bitfield.Bitfield, (totalPieces+7)/8)
+	}
+	st, mem := t.Storage, (*storage.Memory)(nil)
+	if st == nil {
+		if t.mem == nil {
+			t.mem = storage.NewMemory(storage.Layout{PieceLength: t.PieceLength, Length: t.Length})
+		}
+		st, mem = t.mem, t.mem
+	}
+	t.incoming = incoming
+	if t.started.IsZero() {
+		t.started = time.Now()
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.incoming, t.disk = nil, nil
+		t.mu.Unlock()
+		// connections handed over after the loop stopped reading
+		for len(incoming) > 0 {
+			in := <-incoming
+			in.client.Close()
+			t.Limiter.Release()
+			conns.unaccept(in.peer)
+		}
+	}()
+
+	// initialize work queue with pieces that are still missing.
+	// it is never closed, workers stop on ctx and can always requeue work
+	// since the buffer holds every piece
 	workQueue, result := make(chan *pieceWork, totalPieces), make(chan *pieceResult)
 	for idx, hash := range t.PieceHashes {
-		workQueue <- &pieceWork{idx, hash, t.calculatePieceSize(idx)}
+		if t.have.HasPiece(idx) {
+			continue
+		}
+		workQueue <- newPieceWork(idx, hash, t.calculatePieceSize(idx))
 	}
+	donePieces := totalPieces - len(workQueue)
 
-	// start workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, result)
+	// write completions are buffered for every piece so I/O workers never
+	// wait on this loop, the pool is drained before returning
+	disk := storage.NewPool(st, t.IOWorkers, 0)
+	closeDisk := sync.OnceFunc(disk.Close)
+	defer closeDisk()
+	written := make(chan pieceWritten, len(workQueue))
+	// verified pieces waiting for room in the pool queue, the loop keeps
+	// collecting results while the disk is behind
+	var unwritten []*pieceResult
+	queueWrites := func() {
+		for len(unwritten) > 0 {
+			res := unwritten[0]
+			begin, _ := t.calculateBoundsForPiece(res.index)
+			if !disk.TryWritePiece(res.index, res.buf, int64(begin), func(sum [20]byte, err error) {
+				written <- pieceWritten{res.index, sum, err}
+			}) {
+				return
+			}
+			unwritten = unwritten[1:]
+		}
 	}
+	t.mu.Lock()
+	t.disk = disk
+	t.mu.Unlock()
 
-	// collect results into a buffer until full
-	// instead of memory might be able to just use file system
-	buf := make([]byte, t.Length)
-	donePieces := 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.sampleRate(ctx.Done())
+	}()
+
+	// connection manager dials peers and replaces dropped ones
+	conns.add(t.Peers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conns.run(ctx, &wg, workQueue, result)
+	}()
+
+	// collect results until every piece is verified
 	for donePieces < totalPieces {
-		res := <-result
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
+		var w pieceWritten
+		select {
+		case <-ctx.Done():
+			// pieces already handed to the disk still count for a resume
+			closeDisk()
+			for len(written) > 0 {
+				if w := <-written; w.err == nil && w.sum == t.PieceHashes[w.index] {
+					t.mu.Lock()
+					t.have.SetPiece(w.index)
+					t.mu.Unlock()
+				}
+			}
+			stats := t.Stats()
+			return nil, &PartialError{Done: stats.Done, Total: stats.Pieces, Downloaded: stats.Downloaded, Err: ctx.Err()}
+		case in := <-incoming:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// slot was taken in AddClient
+				defer t.Limiter.Release()
+				conns.serve(ctx, in.peer, in.client, workQueue, result)
+			}()
+			continue
+		case res := <-result:
+			unwritten = append(unwritten, res)
+			queueWrites()
+			continue
+		case w = <-written:
+			queueWrites()
+		}
+
+		if w.err != nil {
+			return nil, fmt.Errorf("writing piece %d: %w", w.index, w.err)
+		}
+		if hash := t.PieceHashes[w.index]; w.sum != hash {
+			// the storage returned something else than was written, fetch it again
+			log.Printf("piece %d read back from storage with the wrong hash, downloading it again", w.index)
+			workQueue <- newPieceWork(w.index, hash, t.calculatePieceSize(w.index))
+			continue
+		}
+		t.mu.Lock()
+		t.have.SetPiece(w.index)
+		peers := len(t.clients)
+		t.mu.Unlock()
 		donePieces++
+		t.broadcastHave(w.index)
+		t.emit(Event{Type: EventPieceVerified, Piece: w.index})
 
 		percent := (float64(donePieces) / float64(totalPieces)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread count
-		log.Printf("(%0.2f%%) downloaded piece #%d from #%d peers", percent, res.index, numWorkers)
+		log.Printf("(%0.2f%%) downloaded piece #%d from #%d peers", percent, w.index, peers)
 	}
-	close(workQueue)
 
-	return buf, nil
+	t.emit(Event{Type: EventCompleted})
+	if mem != nil {
+		return mem.Bytes(), nil
+	}
+	return nil, nil
 }
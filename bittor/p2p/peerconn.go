@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"bittor/bitfield"
+	"bittor/client"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// PeerStats is a snapshot of one peer connection
+type PeerStats struct {
+	Addr      string
+	Connected time.Time
+	// block bytes exchanged over this connection
+	Downloaded int64
+	Uploaded   int64
+	// bytes per second over the last sample interval
+	DownloadRate float64
+	UploadRate   float64
+	// the peer doesn't let us request, we don't let the peer request
+	PeerChoking bool
+	AmChoking   bool
+	// the peer wants data from us
+	PeerInterested bool
+	// pieces the peer announced
+	Pieces int
+}
+
+// live state of a connection. The goroutine driving it updates the atomics,
+// PeerStats reads them from anywhere
+type peerConn struct {
+	c     *client.Client
+	up    *uploader
+	addr  string
+	since time.Time
+
+	peerChoking    atomic.Bool
+	amChoking      atomic.Bool
+	peerInterested atomic.Bool
+	pieces         atomic.Int64
+	downloaded     atomic.Int64
+	uploaded       atomic.Int64
+
+	// guarded by Torrent.mu, updated with every rate sample
+	lastDown, lastUp int64
+	downRate, upRate float64
+}
+
+func newPeerConn(c *client.Client) *peerConn {
+	pc := &peerConn{c: c, addr: c.Conn.RemoteAddr().String(), since: time.Now()}
+	pc.peerChoking.Store(c.Choked)
+	pc.amChoking.Store(true)
+	return pc
+}
+
+func (pc *peerConn) setChoked(choked bool) {
+	pc.c.Choked = choked
+	pc.peerChoking.Store(choked)
+}
+
+// records a piece the peer announced
+func (pc *peerConn) have(idx int) {
+	if idx >= 0 && idx < len(pc.c.Bitfield)*8 && !pc.c.Bitfield.HasPiece(idx) {
+		pc.c.Bitfield.SetPiece(idx)
+		pc.pieces.Add(1)
+	}
+}
+
+// takes the peer's bitfield sized to pieces so announced pieces aren't lost,
+// peers without any pieces may not send one
+func (pc *peerConn) setBitfield(bf bitfield.Bitfield, pieces int) {
+	n := (pieces + 7) / 8
+	if len(bf) < n {
+		grown := make(bitfield.Bitfield, n)
+		copy(grown, bf)
+		bf = grown
+	}
+	pc.c.Bitfield = bf
+	pc.countPieces()
+}
+
+func (pc *peerConn) countPieces() {
+	n := 0
+	for idx := range len(pc.c.Bitfield) * 8 {
+		if pc.c.Bitfield.HasPiece(idx) {
+			n++
+		}
+	}
+	pc.pieces.Store(int64(n))
+}
+
+// updates the connection's rates, caller holds Torrent.mu
+func (pc *peerConn) sample(elapsed time.Duration) {
+	down, up := pc.downloaded.Load(), pc.uploaded.Load()
+	pc.downRate = float64(down-pc.lastDown) / elapsed.Seconds()
+	pc.upRate = float64(up-pc.lastUp) / elapsed.Seconds()
+	pc.lastDown, pc.lastUp = down, up
+}
+
+// PeerStats returns a snapshot of every connected peer, fastest first
+func (t *Torrent) PeerStats() []PeerStats {
+	t.mu.Lock()
+	stats := make([]PeerStats, 0, len(t.clients))
+	for _, pc := range t.clients {
+		stats = append(stats, PeerStats{
+			Addr:           pc.addr,
+			Connected:      pc.since,
+			Downloaded:     pc.downloaded.Load(),
+			Uploaded:       pc.uploaded.Load(),
+			DownloadRate:   pc.downRate,
+			UploadRate:     pc.upRate,
+			PeerChoking:    pc.peerChoking.Load(),
+			AmChoking:      pc.amChoking.Load(),
+			PeerInterested: pc.peerInterested.Load(),
+			Pieces:         int(pc.pieces.Load()),
+		})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].DownloadRate != stats[j].DownloadRate {
+			return stats[i].DownloadRate > stats[j].DownloadRate
+		}
+		if stats[i].UploadRate != stats[j].UploadRate {
+			return stats[i].UploadRate > stats[j].UploadRate
+		}
+		return stats[i].Addr < stats[j].Addr
+	})
+	return stats
+}
+
+type PieceState uint8
+
+const (
+	PieceMissing PieceState = iota
+	// a peer is downloading it
+	PieceActive
+	// verified and stored
+	PieceDone
+)
+
+// Pieces returns the state of every piece, e.g. to draw a piece map
+func (t *Torrent) Pieces() []PieceState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make([]PieceState, len(t.PieceHashes))
+	for idx := range states {
+		switch {
+		case t.have.HasPiece(idx):
+			states[idx] = PieceDone
+		case t.active[idx] > 0:
+			states[idx] = PieceActive
+		}
+	}
+	return states
+}
+
+// tracks pieces being downloaded for Pieces
+func (t *Torrent) setActive(idx int, active bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active == nil {
+		t.active = map[int]int{}
+	}
+	if active {
+		t.active[idx]++
+		return
+	}
+	if t.active[idx]--; t.active[idx] <= 0 {
+		delete(t.active, idx)
+	}
+}
@@ -0,0 +1,105 @@
+package p2p
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// pipeline depth used before any throughput has been measured
+	initialBackLog = 5
+	// window over which received bytes are turned into a rate sample
+	rateWindow = time.Second
+	// smoothing factor for rate and rtt moving averages
+	ewmaAlpha = 0.3
+	// over provision the bandwidth-delay product so the pipeline can grow
+	// when the peer has more bandwidth than we are currently using
+	pipelineGain = 1.25
+
+	// bounds for how long a single block request may be outstanding
+	minRequestTimeout = 5 * time.Second
+	maxRequestTimeout = 60 * time.Second
+)
+
+// pipeline sizes the request backlog for a single peer from measured
+// throughput and round trip time (bandwidth-delay product)
+type pipeline struct {
+	// smoothed round trip time of block requests
+	srtt time.Duration
+	// lowest observed round trip time, closest to the propagation delay.
+	// queued requests inflate srtt so it is not used to size the pipeline
+	minRTT time.Duration
+	// smoothed bytes per second
+	rate float64
+
+	windowStart time.Time
+	windowBytes int
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{}
+}
+
+// records n bytes of a block that was requested at sent
+func (p *pipeline) observe(n int, sent time.Time) {
+	now := time.Now()
+
+	if !sent.IsZero() {
+		sample := now.Sub(sent)
+		if p.minRTT == 0 || sample < p.minRTT {
+			p.minRTT = sample
+		}
+		if p.srtt == 0 {
+			p.srtt = sample
+		} else {
+			p.srtt = time.Duration(ewmaAlpha*float64(sample) + (1-ewmaAlpha)*float64(p.srtt))
+		}
+	}
+
+	if p.windowStart.IsZero() {
+		p.windowStart = now
+	}
+	p.windowBytes += n
+
+	elapsed := now.Sub(p.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	sample := float64(p.windowBytes) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate = ewmaAlpha*sample + (1-ewmaAlpha)*p.rate
+	}
+	p.windowStart, p.windowBytes = now, 0
+}
+
+// called when a peer failed to deliver in time, backs the estimates off so
+// fewer requests are handed to it
+func (p *pipeline) stalled() {
+	p.rate /= 2
+	p.srtt *= 2
+	p.windowStart, p.windowBytes = time.Time{}, 0
+}
+
+// number of requests to keep in flight for this peer
+func (p *pipeline) depth() int {
+	if p.rate == 0 || p.minRTT == 0 {
+		return initialBackLog
+	}
+	bdp := p.rate * p.minRTT.Seconds() * pipelineGain
+	depth := int(math.Ceil(bdp/MaxBlockSize)) + 1
+	return min(max(depth, MinBackLog), MaxBackLog)
+}
+
+// how long the oldest of backlog outstanding requests may wait for a response
+func (p *pipeline) timeout(backlog int) time.Duration {
+	if p.srtt == 0 || p.rate == 0 {
+		// nothing measured yet, give a fresh peer the benefit of the doubt
+		return maxRequestTimeout / 2
+	}
+	// time for everything queued ahead to drain plus a round trip, doubled for jitter
+	drain := time.Duration(float64(backlog*MaxBlockSize) / p.rate * float64(time.Second))
+	timeout := 2 * (p.srtt + drain)
+	return min(max(timeout, minRequestTimeout), maxRequestTimeout)
+}
@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"log"
+	"net"
+)
+
+// block of a piece that failed its integrity check, kept to find out which
+// peer sent the bad data once the piece downloads correctly
+type failedBlock struct {
+	peer net.IP
+	hash [20]byte
+}
+
+// distinct peers that delivered blocks of pw
+func (pw *pieceWork) contributors() []net.IP {
+	var peers []net.IP
+	seen := map[string]bool{}
+	for _, b := range pw.blocks {
+		if b.peer == nil || seen[b.peer.String()] {
+			continue
+		}
+		seen[b.peer.String()] = true
+		peers = append(peers, b.peer)
+	}
+	return peers
+}
+
+// called when pw failed its integrity check. A peer that sent the whole
+// piece is struck right away, with several contributors the blocks are
+// remembered until a good copy shows which one was wrong
+func (t *Torrent) attributeFailure(pw *pieceWork) {
+	peers := pw.contributors()
+	if len(peers) == 1 {
+		// already struck, its blocks aren't kept so a good copy can't
+		// count the same failure twice
+		t.strike(peers[0], "hash failure")
+		return
+	}
+
+	pw.failed = make([]failedBlock, len(pw.blocks))
+	for i, b := range pw.blocks {
+		pw.failed[i] = failedBlock{
+			peer: b.peer,
+			hash: sha1.Sum(pw.buf[b.begin : b.begin+b.length]),
+		}
+	}
+}
+
+// called when pw verified after an earlier failure. Every peer whose earlier
+// block differs from the verified data sent corrupt data and gets a strike,
+// once per piece however many of its blocks were bad
+func (t *Torrent) confirmCulprits(pw *pieceWork) {
+	if pw.failed == nil {
+		return
+	}
+	struck := map[string]bool{}
+	for i, b := range pw.blocks {
+		fb := pw.failed[i]
+		if fb.peer == nil || struck[fb.peer.String()] {
+			continue
+		}
+		if sha1.Sum(pw.buf[b.begin:b.begin+b.length]) != fb.hash {
+			struck[fb.peer.String()] = true
+			log.Printf("peer %s sent corrupt block %d of piece %d", fb.peer, b.begin, pw.index)
+			t.strike(fb.peer, "sent corrupt data")
+		}
+	}
+	pw.failed = nil
+}
+
+func (t *Torrent) strike(ip net.IP, reason string) {
+	if t.Bans.Strike(ip, reason) {
+		log.Printf("banned peer %s after repeated hash failures", ip)
+	}
+}
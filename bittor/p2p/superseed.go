@@ -0,0 +1,224 @@
+package p2p
+
+import (
+	"bittor/bitfield"
+	"math/rand/v2"
+	"sync"
+)
+
+// superSeed hands out pieces like an initial seed in BEP 16 superseeding
+// mode: each peer sees a single piece it lacks, offered as a Have, and only
+// gets another once a different peer announces the offered piece. Upload
+// then goes to pieces the swarm doesn't have yet instead of ones peers could
+// fetch from each other
+// https://www.bittorrent.org/beps/bep_0016.html
+type superSeed struct {
+	mu sync.Mutex
+	// pieces we can offer
+	ours bitfield.Bitfield
+	// peers known to have each piece
+	avail []int
+	// peers each piece is currently offered to
+	offers []int
+	peers  map[*uploader]*superSeedPeer
+}
+
+type superSeedPeer struct {
+	has bitfield.Bitfield
+	// pieces offered so far, the only ones the peer may request
+	revealed bitfield.Bitfield
+	// piece waiting to show up at another peer, -1 when none
+	offered int
+}
+
+// a piece to announce to a peer
+type reveal struct {
+	to    *uploader
+	piece int
+}
+
+func newSuperSeed(pieces int, ours bitfield.Bitfield) *superSeed {
+	return &superSeed{
+		ours:   append(bitfield.Bitfield(nil), ours...),
+		avail:  make([]int, pieces),
+		offers: make([]int, pieces),
+		peers:  map[*uploader]*superSeedPeer{},
+	}
+}
+
+// registers a peer with the pieces it has and picks the first piece to offer it
+func (s *superSeed) join(u *uploader, has bitfield.Bitfield) (int, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := &superSeedPeer{
+		has:      append(bitfield.Bitfield(nil), has...),
+		revealed: make(bitfield.Bitfield, len(s.ours)),
+		offered:  -1,
+	}
+	for idx := range s.avail {
+		if p.has.HasPiece(idx) {
+			s.avail[idx]++
+		}
+	}
+	s.peers[u] = p
+	return s.offer(p)
+}
+
+// forgets a peer, its offer goes back to the pool. Peers that were waiting
+// on it to pass their piece on may get their next one
+func (s *superSeed) leave(u *uploader) []reveal {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[u]
+	if !ok {
+		return nil
+	}
+	for idx := range s.avail {
+		if p.has.HasPiece(idx) {
+			s.avail[idx]--
+		}
+	}
+	if p.offered >= 0 {
+		s.offers[p.offered]--
+	}
+	delete(s.peers, u)
+	return s.unblock(nil)
+}
+
+// reports whether u may request piece idx. Without superseeding any piece
+func (s *superSeed) revealed(u *uploader, idx int) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.peers[u]
+	return ok && p.revealed.HasPiece(idx)
+}
+
+// records that u announced piece idx. Peers whose offered piece this is
+// passed it on, each gets its next piece
+func (s *superSeed) have(u *uploader, idx int) []reveal {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.peers[u]
+	if !ok {
+		return nil
+	}
+	return s.addHave(u, p, idx, nil)
+}
+
+// records the bitfield of a peer that sent it after we made our offer. If
+// it already has that piece it gets another
+func (s *superSeed) bitfield(u *uploader, bf bitfield.Bitfield) []reveal {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.peers[u]
+	if !ok {
+		return nil
+	}
+
+	var out []reveal
+	for idx := range s.avail {
+		if bf.HasPiece(idx) {
+			out = s.addHave(u, p, idx, out)
+		}
+	}
+	if p.offered >= 0 && p.has.HasPiece(p.offered) {
+		s.offers[p.offered]--
+		p.offered = -1
+		if next, ok := s.offer(p); ok {
+			out = append(out, reveal{u, next})
+		}
+	}
+	return out
+}
+
+// caller holds s.mu
+func (s *superSeed) addHave(u *uploader, p *superSeedPeer, idx int, out []reveal) []reveal {
+	if idx < 0 || idx >= len(s.avail) || p.has.HasPiece(idx) {
+		return out
+	}
+	p.has.SetPiece(idx)
+	s.avail[idx]++
+
+	for other, op := range s.peers {
+		if other == u || op.offered != idx {
+			continue
+		}
+		s.offers[idx]--
+		op.offered = -1
+		if next, ok := s.offer(op); ok {
+			out = append(out, reveal{other, next})
+		}
+	}
+	return s.unblock(out)
+}
+
+// offers the next piece to peers holding their offered piece when no other
+// peer lacks it, nobody is left to pass it on to. Caller holds s.mu
+func (s *superSeed) unblock(out []reveal) []reveal {
+	for u, p := range s.peers {
+		if p.offered < 0 || !p.has.HasPiece(p.offered) || s.wanted(p.offered, u) {
+			continue
+		}
+		s.offers[p.offered]--
+		p.offered = -1
+		if next, ok := s.offer(p); ok {
+			out = append(out, reveal{u, next})
+		}
+	}
+	return out
+}
+
+// reports whether a peer other than u lacks piece idx. Caller holds s.mu
+func (s *superSeed) wanted(idx int, u *uploader) bool {
+	for other, p := range s.peers {
+		if other != u && !p.has.HasPiece(idx) {
+			return true
+		}
+	}
+	return false
+}
+
+// picks the rarest piece p lacks, counting pending offers as copies so
+// concurrent peers get different pieces. Caller holds s.mu
+func (s *superSeed) offer(p *superSeedPeer) (int, bool) {
+	n := len(s.avail)
+	best, bestCount := -1, 0
+	// random start so ties don't all go to the lowest index
+	start := 0
+	if n > 0 {
+		start = rand.IntN(n)
+	}
+	for i := range n {
+		idx := (start + i) % n
+		if !s.ours.HasPiece(idx) || p.has.HasPiece(idx) || p.revealed.HasPiece(idx) {
+			continue
+		}
+		if count := s.avail[idx] + s.offers[idx]; best < 0 || count < bestCount {
+			best, bestCount = idx, count
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	p.offered = best
+	p.revealed.SetPiece(best)
+	s.offers[best]++
+	return best, true
+}
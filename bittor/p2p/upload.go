@@ -0,0 +1,344 @@
+package p2p
+
+import (
+	"bittor/bitfield"
+	"bittor/client"
+	"bittor/message"
+	"bittor/storage"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// default number of peers unchoked at once while seeding
+	DefaultMaxUploads = 4
+	// largest block we serve, peers asking for more are dropped
+	maxRequestLength = 2 * MaxBlockSize
+	// how often a seeding connection retries for a free upload slot
+	uploadSlotInterval = 2 * time.Second
+	// blocks per peer being read or waiting to be sent, well below the
+	// client's send queue so replies never find it full
+	maxUploadBlocks = 16
+)
+
+var (
+	errBadRequest = errors.New("invalid block request")
+	errBothSeeds  = errors.New("peer is a seed too")
+)
+
+// answers the block requests of one peer from verified pieces. Driven by
+// the goroutine reading the connection, requests are served in order
+type uploader struct {
+	t  *Torrent
+	pc *peerConn
+	c  *client.Client
+	// upload slots while seeding, nil unchokes every peer
+	slots chan struct{}
+	// nil unless superseeding
+	ss *superSeed
+	// a token per block read from disk until it was sent
+	blocks chan struct{}
+
+	interested bool
+	unchoked   bool
+	slot       bool
+}
+
+func newUploader(t *Torrent, pc *peerConn, slots chan struct{}, ss *superSeed) *uploader {
+	return &uploader{t: t, pc: pc, c: pc.c, slots: slots, ss: ss, blocks: make(chan struct{}, maxUploadBlocks)}
+}
+
+// handles a message concerning our upload to the peer
+func (u *uploader) handle(msg *message.Message) error {
+	switch msg.ID {
+	case message.MsgBitfield:
+		// peers that dialed us send it after the handshake
+		u.pc.setBitfield(msg.Payload, len(u.t.PieceHashes))
+		u.reveal(u.ss.bitfield(u, u.c.Bitfield))
+		if u.t.isSeed(u.c.Bitfield) {
+			return errBothSeeds
+		}
+	case message.MsgInterested:
+		u.interested = true
+		u.pc.peerInterested.Store(true)
+		return u.unchoke()
+	case message.MsgNotInterested:
+		u.interested = false
+		u.pc.peerInterested.Store(false)
+		return u.choke()
+	case message.MsgRequest:
+		return u.request(msg)
+	case message.MsgCancel:
+		// requests are answered as they are read, a cancel always comes
+		// after the block went out
+	case message.MsgHave:
+		idx, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		u.pc.have(idx)
+		u.reveal(u.ss.have(u, idx))
+		if u.t.isSeed(u.c.Bitfield) {
+			return errBothSeeds
+		}
+	}
+	return nil
+}
+
+// unchokes the peer if a slot is free, a later tick retries otherwise
+func (u *uploader) unchoke() error {
+	if u.unchoked {
+		return nil
+	}
+	if u.slots != nil {
+		select {
+		case u.slots <- struct{}{}:
+			u.slot = true
+		default:
+			return nil
+		}
+	}
+	u.unchoked = true
+	u.pc.amChoking.Store(false)
+	return u.c.SendUnchoke()
+}
+
+// gives the slot back. Without slots peers stay unchoked for good
+func (u *uploader) choke() error {
+	if !u.slot {
+		return nil
+	}
+	<-u.slots
+	u.slot, u.unchoked = false, false
+	u.pc.amChoking.Store(true)
+	return u.c.SendChoke()
+}
+
+// called periodically while seeding
+func (u *uploader) tick() error {
+	if u.interested {
+		return u.unchoke()
+	}
+	return nil
+}
+
+func (u *uploader) request(msg *message.Message) error {
+	idx, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if idx < 0 || idx >= len(u.t.PieceHashes) || length <= 0 || length > maxRequestLength ||
+		begin < 0 || begin+length > u.t.calculatePieceSize(idx) {
+		return fmt.Errorf("%w: piece %d offset %d length %d", errBadRequest, idx, begin, length)
+	}
+	// requests of choked peers are dropped, so are pieces we can't or won't share
+	if !u.unchoked || !u.t.hasPiece(idx) || !u.ss.revealed(u, idx) {
+		return nil
+	}
+	disk := u.t.diskPool()
+	if disk == nil {
+		return nil
+	}
+
+	// waits for earlier blocks to go out, the peer's own backpressure
+	select {
+	case u.blocks <- struct{}{}:
+	case <-u.c.Done():
+		return u.c.Err()
+	}
+	release := func() { <-u.blocks }
+
+	// the reply goes out from the disk worker, reading the peer's next
+	// messages meanwhile
+	block := make([]byte, length)
+	start, _ := u.t.calculateBoundsForPiece(idx)
+	disk.Read(block, int64(start+begin), func(n int, err error) {
+		if err == nil && n != length {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			release()
+			if !errors.Is(err, storage.ErrPoolClosed) {
+				log.Printf("reading piece %d for %s: %v", idx, u.c.Peer(), err)
+				u.c.Close()
+			}
+			return
+		}
+		if err := u.c.TrySendPiece(idx, begin, block, release); err != nil {
+			release()
+			return
+		}
+		u.t.uploaded.Add(int64(length))
+		u.pc.uploaded.Add(int64(length))
+	})
+	return nil
+}
+
+// sends pieces superseeding revealed to their peers
+func (u *uploader) reveal(reveals []reveal) {
+	for _, r := range reveals {
+		r.to.c.TrySendHave(r.piece)
+	}
+}
+
+// releases the slot and the superseeding state of the peer
+func (u *uploader) close() {
+	if u.slot {
+		<-u.slots
+		u.slot = false
+	}
+	u.reveal(u.ss.leave(u))
+}
+
+// Bitfield returns the pieces announced to peers when connecting: the
+// verified ones, none while superseeding. nil when there's nothing to announce
+func (t *Torrent) Bitfield() bitfield.Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.superSeed != nil {
+		return nil
+	}
+	for _, b := range t.have {
+		if b != 0 {
+			return append(bitfield.Bitfield(nil), t.have...)
+		}
+	}
+	return nil
+}
+
+func (t *Torrent) hasPiece(idx int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.have.HasPiece(idx)
+}
+
+// reports whether bf has every piece
+func (t *Torrent) isSeed(bf bitfield.Bitfield) bool {
+	for idx := range t.PieceHashes {
+		if !bf.HasPiece(idx) {
+			return false
+		}
+	}
+	return true
+}
+
+// pool serving reads while downloading or seeding, nil otherwise
+func (t *Torrent) diskPool() *storage.Pool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.disk
+}
+
+// Seed uploads verified pieces to peers handed over with AddClient, e.g. by
+// Serve, until ctx is done. It doesn't dial out, peers find a seed through
+// the tracker. Up to MaxUploads interested peers are unchoked at a time.
+// With SuperSeed set pieces are revealed one at a time (BEP 16)
+func (t *Torrent) Seed(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	t.mu.Lock()
+	if t.incoming != nil {
+		t.mu.Unlock()
+		return errors.New("torrent is already running")
+	}
+	st := t.Storage
+	if st == nil && t.mem != nil {
+		st = t.mem
+	}
+	if st == nil || t.have == nil {
+		t.mu.Unlock()
+		return errors.New("nothing to seed, no verified pieces")
+	}
+	if t.conns == nil {
+		t.conns = newConnManager(t)
+	}
+	conns := t.conns
+	var ss *superSeed
+	if t.SuperSeed {
+		ss = newSuperSeed(len(t.PieceHashes), t.have)
+	}
+	disk := storage.NewPool(st, t.IOWorkers, 0)
+	defer disk.Close()
+	incoming := make(chan incomingConn, 16)
+	t.incoming, t.disk, t.superSeed = incoming, disk, ss
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.incoming, t.disk, t.superSeed = nil, nil, nil
+		t.mu.Unlock()
+		for len(incoming) > 0 {
+			in := <-incoming
+			in.client.Close()
+			t.Limiter.Release()
+			conns.unaccept(in.peer)
+		}
+	}()
+
+	maxUploads := t.MaxUploads
+	if maxUploads <= 0 {
+		maxUploads = DefaultMaxUploads
+	}
+	slots := make(chan struct{}, maxUploads)
+	log.Printf("seeding %s", t.Name)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case in := <-incoming:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// slot was taken in AddClient
+				defer t.Limiter.Release()
+				t.seedPeer(ctx, in.client, slots, ss)
+				conns.unaccept(in.peer)
+			}()
+		}
+	}
+}
+
+// uploads to one peer until it disconnects or ctx is done
+func (t *Torrent) seedPeer(ctx context.Context, c *client.Client, slots chan struct{}, ss *superSeed) {
+	pc := t.peerConnected(c)
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	u := newUploader(t, pc, slots, ss)
+	pc.up = u
+	var reason error
+	defer func() {
+		stop()
+		u.close()
+		c.Close()
+		if ctx.Err() != nil {
+			reason = ctx.Err()
+		}
+		t.peerDisconnected(pc, reason)
+	}()
+
+	if piece, ok := ss.join(u, c.Bitfield); ok {
+		c.SendHave(piece)
+	}
+
+	for {
+		msg, err := c.Read(time.Now().Add(uploadSlotInterval))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = u.tick()
+		}
+		if err == nil && msg != nil {
+			err = u.handle(msg)
+		}
+		if err != nil {
+			reason = err
+			return
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package peer
+
+import (
+	"math/rand/v2"
+)
+
+// ClientPrefix identifies this client in Azureus style peer ids,
+// `-` client code, four version digits, `-`
+// https://www.bittorrent.org/beps/bep_0020.html
+const ClientPrefix = "-GS0001-"
+
+const idChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// NewID returns ClientPrefix followed by random printable characters, so the
+// id stays readable in tracker logs and peer lists
+func NewID() [20]byte {
+	var id [20]byte
+	n := copy(id[:], ClientPrefix)
+	for i := n; i < len(id); i++ {
+		id[i] = idChars[rand.IntN(len(idChars))]
+	}
+	return id
+}
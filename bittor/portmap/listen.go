@@ -0,0 +1,40 @@
+package portmap
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ports tried in order when no listen port is configured, the range clients
+// traditionally use. Any free port is taken when all of them are busy
+const (
+	FirstPort uint16 = 6881
+	LastPort  uint16 = 6889
+)
+
+// Listen opens the peer listener on port, or when port is 0 on the first
+// free port between FirstPort and LastPort
+func Listen(port uint16) (net.Listener, error) {
+	if port != 0 {
+		return net.Listen("tcp", ":"+strconv.Itoa(int(port)))
+	}
+	for p := FirstPort; p <= LastPort; p++ {
+		if ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(p))); err == nil {
+			return ln, nil
+		}
+	}
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("no free listen port: %w", err)
+	}
+	return ln, nil
+}
+
+// ListenPort returns the port ln is bound to
+func ListenPort(ln net.Listener) uint16 {
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc6886
+const (
+	natpmpPort    = 5351
+	natpmpVersion = 0
+
+	natpmpOpExternal = 0
+	natpmpOpMapUDP   = 1
+	natpmpOpMapTCP   = 2
+	// responses carry the request opcode plus 128
+	natpmpOpResponse = 128
+
+	// first retransmission, doubled on each attempt
+	natpmpInitialWait = 250 * time.Millisecond
+	natpmpAttempts    = 4
+)
+
+var natpmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+type natpmp struct {
+	gateway string
+}
+
+func (n *natpmp) name() string {
+	return "NAT-PMP"
+}
+
+func (n *natpmp) externalIP(ctx context.Context) (net.IP, error) {
+	res, err := n.roundTrip(ctx, []byte{natpmpVersion, natpmpOpExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(res[8:12]), nil
+}
+
+func (n *natpmp) addMapping(ctx context.Context, internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	req := make([]byte, 12)
+	req[0], req[1] = natpmpVersion, natpmpOpMapTCP
+	binary.BigEndian.PutUint16(req[4:], internal)
+	binary.BigEndian.PutUint16(req[6:], external)
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	res, err := n.roundTrip(ctx, req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if got := binary.BigEndian.Uint16(res[8:]); got != internal {
+		return 0, 0, fmt.Errorf("gateway answered for port %d, asked for %d", got, internal)
+	}
+	mapped := binary.BigEndian.Uint16(res[10:])
+	granted := time.Duration(binary.BigEndian.Uint32(res[12:])) * time.Second
+	return mapped, granted, nil
+}
+
+// sends req retransmitting with backoff until a matching response of size
+// bytes arrives
+func (n *natpmp) roundTrip(ctx context.Context, req []byte, size int) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", n.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	res := make([]byte, 16)
+	wait := natpmpInitialWait
+	for range natpmpAttempts {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		for {
+			nr, err := conn.Read(res)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if nr < size || res[0] != natpmpVersion || res[1] != req[1]+natpmpOpResponse {
+				// stray or malformed packet, keep waiting
+				continue
+			}
+			if code := binary.BigEndian.Uint16(res[2:]); code != 0 {
+				reason, ok := natpmpResults[code]
+				if !ok {
+					reason = fmt.Sprintf("result code %d", code)
+				}
+				return nil, fmt.Errorf("gateway refused: %s", reason)
+			}
+			return res[:size], nil
+		}
+		wait *= 2
+	}
+	return nil, fmt.Errorf("no response from %s", n.gateway)
+}
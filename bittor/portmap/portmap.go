@@ -0,0 +1,208 @@
+// Package portmap forwards the peer listen port on the local gateway with
+// NAT-PMP (RFC 6886) or UPnP IGD, so peers behind the same kind of NAT can
+// still connect to us
+package portmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// lease asked for, mappings are renewed at half of what was granted
+	DefaultLifetime = time.Hour
+	// how long discovery and a single request may take
+	requestTimeout = 5 * time.Second
+	// first retry after a failed renewal, doubled per failure
+	DefaultRetryInterval = time.Minute
+	// retries back off to at most this many retry intervals
+	maxRetryBackoff = 16
+)
+
+var ErrNoGateway = errors.New("no NAT-PMP or UPnP gateway found")
+
+// Config selects how the gateway is found. Zero values discover it
+type Config struct {
+	// NAT-PMP gateway as host:port, defaults to the default route on 5351
+	NATPMPGateway string
+	// UPnP root device description url, defaults to SSDP discovery
+	UPnPLocation string
+	// disables one of the protocols
+	DisableNATPMP bool
+	DisableUPnP   bool
+	Lifetime      time.Duration
+	// DefaultRetryInterval when 0
+	RetryInterval time.Duration
+	// shown in the router's UPnP mapping table
+	Description string
+}
+
+// a protocol specific gateway client
+type mapper interface {
+	name() string
+	externalIP(ctx context.Context) (net.IP, error)
+	// lifetime 0 deletes the mapping
+	addMapping(ctx context.Context, internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error)
+}
+
+// Mapping is a forwarded TCP port kept alive until Close
+type Mapping struct {
+	// NAT-PMP or UPnP
+	Method       string
+	InternalPort uint16
+	ExternalIP   net.IP
+
+	m      mapper
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	external uint16
+}
+
+// ExternalPort is the port peers should connect to, gateways may hand out a
+// different one than asked for
+func (m *Mapping) ExternalPort() uint16 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.external
+}
+
+func (m *Mapping) String() string {
+	return fmt.Sprintf("%s %s -> :%d", m.Method, net.JoinHostPort(m.ExternalIP.String(), fmt.Sprint(m.ExternalPort())), m.InternalPort)
+}
+
+// Map forwards TCP port on the gateway and renews the lease in the
+// background until Close. NAT-PMP is tried first, then UPnP
+func Map(ctx context.Context, cfg Config, port uint16) (*Mapping, error) {
+	if cfg.Lifetime <= 0 {
+		cfg.Lifetime = DefaultLifetime
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	if cfg.Description == "" {
+		cfg.Description = "bittor"
+	}
+
+	var errs []error
+	for _, m := range discover(ctx, cfg) {
+		mapping, err := start(ctx, m, port, cfg)
+		if err == nil {
+			return mapping, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", m.name(), err))
+	}
+	if len(errs) == 0 {
+		return nil, ErrNoGateway
+	}
+	return nil, errors.Join(errs...)
+}
+
+func discover(ctx context.Context, cfg Config) []mapper {
+	var mappers []mapper
+	if !cfg.DisableNATPMP {
+		addr := cfg.NATPMPGateway
+		if addr == "" {
+			if gw, err := defaultGateway(); err == nil {
+				addr = net.JoinHostPort(gw.String(), fmt.Sprint(natpmpPort))
+			}
+		}
+		if addr != "" {
+			mappers = append(mappers, &natpmp{gateway: addr})
+		}
+	}
+	if !cfg.DisableUPnP {
+		location := cfg.UPnPLocation
+		if location == "" {
+			dctx, cancel := context.WithTimeout(ctx, requestTimeout)
+			location, _ = ssdpDiscover(dctx)
+			cancel()
+		}
+		if location != "" {
+			mappers = append(mappers, &upnp{location: location, description: cfg.Description})
+		}
+	}
+	return mappers
+}
+
+func start(ctx context.Context, m mapper, port uint16, cfg Config) (*Mapping, error) {
+	rctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	ip, err := m.externalIP(rctx)
+	if err != nil {
+		return nil, err
+	}
+	external, granted, err := m.addMapping(rctx, port, port, cfg.Lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := &Mapping{
+		Method:       m.name(),
+		InternalPort: port,
+		ExternalIP:   ip,
+		m:            m,
+		done:         make(chan struct{}),
+		external:     external,
+	}
+	var kctx context.Context
+	kctx, mapping.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	go mapping.keep(kctx, cfg, granted)
+	return mapping, nil
+}
+
+// renews the lease at half its granted lifetime, a lifetime of 0 is
+// permanent. Failed renewals are retried with backoff until one succeeds,
+// also after the old lease ran out
+func (m *Mapping) keep(ctx context.Context, cfg Config, granted time.Duration) {
+	defer close(m.done)
+	wait := granted / 2
+	retry := cfg.RetryInterval
+	for {
+		if wait <= 0 {
+			<-ctx.Done()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		rctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		external, lifetime, err := m.m.addMapping(rctx, m.InternalPort, m.ExternalPort(), cfg.Lifetime)
+		cancel()
+		if err != nil {
+			log.Printf("renewing %s port mapping failed, retrying in %v: %v", m.Method, retry, err)
+			wait = retry
+			retry = min(2*retry, maxRetryBackoff*cfg.RetryInterval)
+			continue
+		}
+
+		m.mu.Lock()
+		if external != m.external {
+			log.Printf("%s gateway moved mapping of port %d from %d to %d", m.Method, m.InternalPort, m.external, external)
+		}
+		m.external = external
+		m.mu.Unlock()
+		wait, retry = lifetime/2, cfg.RetryInterval
+	}
+}
+
+// Close stops renewing and removes the mapping from the gateway
+func (m *Mapping) Close() error {
+	m.cancel()
+	<-m.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, _, err := m.m.addMapping(ctx, m.InternalPort, m.ExternalPort(), 0)
+	return err
+}
@@ -0,0 +1,215 @@
+package portmap_test
+
+import (
+	"bittor/portmap"
+	"bittor/portmap/portmaptest"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+const port = 6881
+
+func newGateway(t *testing.T) *portmaptest.Gateway {
+	t.Helper()
+	g, err := portmaptest.NewGateway()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	return g
+}
+
+// waits until the gateway saw at least n mapping requests
+func waitRequests(t *testing.T, g *portmaptest.Gateway, n int, within time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for g.Requests() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("gateway saw %d mapping requests, want %d", g.Requests(), n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestMap(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(g *portmaptest.Gateway) portmap.Config
+		method string
+		// added to the requested port by the gateway
+		offset   uint16
+		external uint16
+	}{
+		{
+			name: "NAT-PMP",
+			config: func(g *portmaptest.Gateway) portmap.Config {
+				return portmap.Config{NATPMPGateway: g.NATPMPAddr, DisableUPnP: true}
+			},
+			method:   "NAT-PMP",
+			external: port,
+		},
+		{
+			name: "NAT-PMP other port",
+			config: func(g *portmaptest.Gateway) portmap.Config {
+				return portmap.Config{NATPMPGateway: g.NATPMPAddr, DisableUPnP: true}
+			},
+			method:   "NAT-PMP",
+			offset:   1000,
+			external: port + 1000,
+		},
+		{
+			name: "UPnP",
+			config: func(g *portmaptest.Gateway) portmap.Config {
+				return portmap.Config{UPnPLocation: g.UPnPLocation, DisableNATPMP: true}
+			},
+			method:   "UPnP",
+			external: port,
+		},
+		{
+			name: "UPnP after NAT-PMP failed",
+			config: func(g *portmaptest.Gateway) portmap.Config {
+				return portmap.Config{NATPMPGateway: closedUDPAddr(t), UPnPLocation: g.UPnPLocation}
+			},
+			method:   "UPnP",
+			external: port,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGateway(t)
+			g.SetPortOffset(tt.offset)
+			cfg := tt.config(g)
+			cfg.Lifetime = 2 * time.Second
+
+			m, err := portmap.Map(context.Background(), cfg, port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Method != tt.method || !m.ExternalIP.Equal(g.ExternalIP) || m.ExternalPort() != tt.external {
+				t.Fatalf("mapped %s, want %s %s:%d", m, tt.method, g.ExternalIP, tt.external)
+			}
+			leases := g.Leases()
+			if len(leases) != 1 || leases[0].Method != tt.method || leases[0].InternalPort != port || leases[0].ExternalPort != tt.external {
+				t.Fatalf("gateway holds %+v", leases)
+			}
+			first := leases[0].Expires
+
+			// renewed at half the granted lifetime, keeping the port
+			waitRequests(t, g, 2, 3*time.Second)
+			leases = g.Leases()
+			if len(leases) != 1 || !leases[0].Expires.After(first) || leases[0].ExternalPort != tt.external {
+				t.Fatalf("after renewal gateway holds %+v, first lease expired %v", leases, first)
+			}
+			if m.ExternalPort() != tt.external {
+				t.Fatalf("renewal moved the mapping to port %d", m.ExternalPort())
+			}
+
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if leases := g.Leases(); len(leases) != 0 {
+				t.Fatalf("gateway still holds %+v after Close", leases)
+			}
+		})
+	}
+}
+
+// routers that only take permanent UPnP leases get one, it isn't renewed and
+// Close still removes it
+func TestMapUPnPPermanentOnly(t *testing.T) {
+	g := newGateway(t)
+	g.SetPermanentOnly(true)
+	cfg := portmap.Config{UPnPLocation: g.UPnPLocation, DisableNATPMP: true, Lifetime: time.Second}
+
+	m, err := portmap.Map(context.Background(), cfg, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases := g.Leases()
+	if len(leases) != 1 || !leases[0].Expires.IsZero() {
+		t.Fatalf("gateway holds %+v, want one permanent lease", leases)
+	}
+	// a renewal would show up as another request
+	requests := g.Requests()
+	time.Sleep(1500 * time.Millisecond)
+	if g.Requests() != requests {
+		t.Fatalf("permanent mapping was renewed, %d requests after %d", g.Requests(), requests)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if leases := g.Leases(); len(leases) != 0 {
+		t.Fatalf("gateway still holds %+v after Close", leases)
+	}
+}
+
+// failed renewals are retried until the gateway takes one again, even once
+// the old lease ran out
+func TestMapRenewalRetried(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(g *portmaptest.Gateway) portmap.Config
+	}{
+		{"NAT-PMP", func(g *portmaptest.Gateway) portmap.Config {
+			return portmap.Config{NATPMPGateway: g.NATPMPAddr, DisableUPnP: true}
+		}},
+		{"UPnP", func(g *portmaptest.Gateway) portmap.Config {
+			return portmap.Config{UPnPLocation: g.UPnPLocation, DisableNATPMP: true}
+		}},
+	}
+
+	const failures = 5
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGateway(t)
+			cfg := tt.config(g)
+			cfg.Lifetime = 2 * time.Second
+			cfg.RetryInterval = 50 * time.Millisecond
+
+			m, err := portmap.Map(context.Background(), cfg, port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			g.SetFailures(failures)
+
+			// the renewal at 1s and the retries after it fail, backing off
+			// from 50ms to 800ms, the lease expires in between
+			requests := g.Requests()
+			waitRequests(t, g, requests+failures, 4*time.Second)
+			waitRequests(t, g, requests+failures+1, 2*time.Second)
+			leases := g.Leases()
+			if len(leases) != 1 || leases[0].ExternalPort != port {
+				t.Fatalf("after the retries gateway holds %+v", leases)
+			}
+
+			// back to renewing at half the lifetime
+			waitRequests(t, g, requests+failures+2, 2*time.Second)
+			if leases := g.Leases(); len(leases) != 1 || m.ExternalPort() != port {
+				t.Fatalf("gateway holds %+v, mapped to %d", leases, m.ExternalPort())
+			}
+		})
+	}
+}
+
+func TestMapNoGateway(t *testing.T) {
+	cfg := portmap.Config{DisableNATPMP: true, DisableUPnP: true}
+	if _, err := portmap.Map(context.Background(), cfg, port); err != portmap.ErrNoGateway {
+		t.Fatalf("got %v, want %v", err, portmap.ErrNoGateway)
+	}
+}
+
+// an address nothing listens on, NAT-PMP requests to it are refused
+func closedUDPAddr(t *testing.T) string {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
@@ -0,0 +1,324 @@
+// Package portmaptest provides a local stand-in gateway that speaks NAT-PMP
+// and UPnP IGD, to exercise port mapping without a router
+package portmaptest
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const serviceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+// Lease is a port mapping the gateway currently holds
+type Lease struct {
+	// NAT-PMP or UPnP
+	Method       string
+	InternalIP   string
+	InternalPort uint16
+	ExternalPort uint16
+	// zero for permanent UPnP mappings
+	Expires time.Time
+}
+
+// Gateway answers NAT-PMP on a local UDP port and serves an IGD device
+// description and control endpoint over HTTP. Pass NATPMPAddr and
+// UPnPLocation in portmap.Config
+type Gateway struct {
+	NATPMPAddr   string
+	UPnPLocation string
+	ExternalIP   net.IP
+
+	pc    net.PacketConn
+	srv   *httptest.Server
+	epoch time.Time
+
+	mu            sync.Mutex
+	permanentOnly bool
+	portOffset    uint16
+	leases        map[string]Lease
+	// requests seen, to check renewals happened
+	requests int
+	// mapping requests still to be refused
+	failures int
+}
+
+func NewGateway() (*Gateway, error) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	g := &Gateway{
+		NATPMPAddr: pc.LocalAddr().String(),
+		ExternalIP: net.IPv4(203, 0, 113, 7),
+		pc:         pc,
+		epoch:      time.Now(),
+		leases:     map[string]Lease{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rootDesc.xml", g.serveDescription)
+	mux.HandleFunc("POST /ctl/IPConn", g.serveControl)
+	g.srv = httptest.NewServer(mux)
+	g.UPnPLocation = g.srv.URL + "/rootDesc.xml"
+
+	go g.serveNATPMP()
+	return g, nil
+}
+
+func (g *Gateway) Close() {
+	g.pc.Close()
+	g.srv.Close()
+}
+
+// SetPermanentOnly makes UPnP reject leases other than 0 like many home
+// routers do
+func (g *Gateway) SetPermanentOnly(on bool) {
+	g.mu.Lock()
+	g.permanentOnly = on
+	g.mu.Unlock()
+}
+
+// SetPortOffset is added to requested NAT-PMP external ports, gateways may
+// not grant the one asked for
+func (g *Gateway) SetPortOffset(offset uint16) {
+	g.mu.Lock()
+	g.portOffset = offset
+	g.mu.Unlock()
+}
+
+// SetFailures makes the next n mapping requests fail, as a gateway that is
+// rebooting or out of resources would
+func (g *Gateway) SetFailures(n int) {
+	g.mu.Lock()
+	g.failures = n
+	g.mu.Unlock()
+}
+
+// counts a mapping request and reports whether it should be refused
+func (g *Gateway) fail() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.failures == 0 {
+		return false
+	}
+	g.failures--
+	g.requests++
+	return true
+}
+
+// Leases returns the current mappings ordered by external port
+func (g *Gateway) Leases() []Lease {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	leases := make([]Lease, 0, len(g.leases))
+	for _, l := range g.leases {
+		if l.Expires.IsZero() || time.Now().Before(l.Expires) {
+			leases = append(leases, l)
+		}
+	}
+	slices.SortFunc(leases, func(a, b Lease) int { return int(a.ExternalPort) - int(b.ExternalPort) })
+	return leases
+}
+
+// Requests counts mapping requests, including renewals and deletions
+func (g *Gateway) Requests() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests
+}
+
+// records a lease, remap applies the port offset to new mappings
+func (g *Gateway) set(method string, ip string, internal, external uint16, lifetime time.Duration, remap bool) uint16 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests++
+	key := fmt.Sprintf("%s/%d", method, internal)
+	if lifetime == 0 && method == "NAT-PMP" {
+		delete(g.leases, key)
+		return 0
+	}
+	// renewals keep the port granted before
+	if l, ok := g.leases[key]; ok {
+		external = l.ExternalPort
+	} else if remap {
+		external += g.portOffset
+	}
+	l := Lease{Method: method, InternalIP: ip, InternalPort: internal, ExternalPort: external}
+	if lifetime > 0 {
+		l.Expires = time.Now().Add(lifetime)
+	}
+	g.leases[key] = l
+	return external
+}
+
+func (g *Gateway) remove(method string, external uint16) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests++
+	for key, l := range g.leases {
+		if l.Method == method && l.ExternalPort == external {
+			delete(g.leases, key)
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) serveNATPMP() {
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := g.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 2 || buf[0] != 0 {
+			continue
+		}
+
+		op := buf[1]
+		res := make([]byte, 16)
+		res[1] = op + 128
+		binary.BigEndian.PutUint32(res[4:], uint32(time.Since(g.epoch)/time.Second))
+		switch {
+		case op == 0:
+			copy(res[8:12], g.ExternalIP.To4())
+			res = res[:12]
+		case (op == 1 || op == 2) && n >= 12 && g.fail():
+			// out of resources
+			binary.BigEndian.PutUint16(res[2:], 4)
+		case (op == 1 || op == 2) && n >= 12:
+			internal := binary.BigEndian.Uint16(buf[4:])
+			external := binary.BigEndian.Uint16(buf[6:])
+			lifetime := time.Duration(binary.BigEndian.Uint32(buf[8:])) * time.Second
+			host, _, _ := net.SplitHostPort(addr.String())
+			external = g.set("NAT-PMP", host, internal, external, lifetime, true)
+			binary.BigEndian.PutUint16(res[8:], internal)
+			binary.BigEndian.PutUint16(res[10:], external)
+			binary.BigEndian.PutUint32(res[12:], uint32(lifetime/time.Second))
+		default:
+			// unsupported opcode
+			binary.BigEndian.PutUint16(res[2:], 5)
+			res = res[:8]
+		}
+		g.pc.WriteTo(res, addr)
+	}
+}
+
+func (g *Gateway) serveDescription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+ <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+ <deviceList><device>
+  <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+  <deviceList><device>
+   <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+   <serviceList><service>
+    <serviceType>`+serviceType+`</serviceType>
+    <controlURL>/ctl/IPConn</controlURL>
+   </service></serviceList>
+  </device></deviceList>
+ </device></deviceList>
+</device>
+</root>`)
+}
+
+// reads the action name and its arguments from a SOAP request
+func soapRequest(r io.Reader) (string, map[string]string, error) {
+	dec := xml.NewDecoder(r)
+	args := map[string]string{}
+	var action, name string
+	var depth int
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return action, args, nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			// Envelope > Body > action > argument
+			if depth == 3 {
+				action = t.Name.Local
+			}
+			name = t.Name.Local
+		case xml.CharData:
+			if depth == 4 {
+				args[name] = string(t)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+func (g *Gateway) serveControl(w http.ResponseWriter, r *http.Request) {
+	action, args, err := soapRequest(r.Body)
+	if err != nil || r.Header.Get("SOAPAction") != `"`+serviceType+"#"+action+`"` {
+		soapFault(w, 401, "Invalid Action")
+		return
+	}
+
+	switch action {
+	case "GetExternalIPAddress":
+		soapReply(w, action, "<NewExternalIPAddress>"+g.ExternalIP.String()+"</NewExternalIPAddress>")
+	case "AddPortMapping":
+		lease, _ := strconv.Atoi(args["NewLeaseDuration"])
+		g.mu.Lock()
+		permanentOnly := g.permanentOnly
+		g.mu.Unlock()
+		if g.fail() {
+			soapFault(w, 501, "Action Failed")
+			return
+		}
+		if permanentOnly && lease != 0 {
+			soapFault(w, 725, "OnlyPermanentLeasesSupported")
+			return
+		}
+		internal, err1 := strconv.ParseUint(args["NewInternalPort"], 10, 16)
+		external, err2 := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		if err1 != nil || err2 != nil || !strings.EqualFold(args["NewProtocol"], "TCP") {
+			soapFault(w, 402, "Invalid Args")
+			return
+		}
+		// UPnP has no way to hand back another port, the offset doesn't apply
+		g.set("UPnP", args["NewInternalClient"], uint16(internal), uint16(external), time.Duration(lease)*time.Second, false)
+		soapReply(w, action, "")
+	case "DeletePortMapping":
+		external, _ := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		if !g.remove("UPnP", uint16(external)) {
+			soapFault(w, 714, "NoSuchEntryInArray")
+			return
+		}
+		soapReply(w, action, "")
+	default:
+		soapFault(w, 401, "Invalid Action")
+	}
+}
+
+func soapReply(w http.ResponseWriter, action, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action, serviceType, body, action)
+}
+
+func soapFault(w http.ResponseWriter, code int, desc string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`,
+		code, desc)
+}
@@ -0,0 +1,296 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddr   = "239.255.255.250:1900"
+	igdTarget  = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	wanIPConn  = "urn:schemas-upnp-org:service:WANIPConnection:"
+	wanPPPConn = "urn:schemas-upnp-org:service:WANPPPConnection:"
+
+	// UPnP error code for routers that refuse leases other than 0
+	upnpOnlyPermanentLeases = 725
+)
+
+// UPnPError is a fault returned by the gateway's control endpoint
+type UPnPError struct {
+	Code        int
+	Description string
+}
+
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("upnp error %d: %s", e.Code, e.Description)
+}
+
+type upnp struct {
+	location    string
+	description string
+
+	// resolved on first use
+	controlURL  string
+	serviceType string
+}
+
+func (u *upnp) name() string {
+	return "UPnP"
+}
+
+// multicasts an M-SEARCH for an internet gateway and returns the location of
+// the first device description that answers
+func ssdpDiscover(ctx context.Context) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + igdTarget + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return "", ErrNoGateway
+			}
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if loc := resp.Header.Get("Location"); loc != "" {
+			return loc, nil
+		}
+	}
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// WAN connection service, nested somewhere below the gateway device
+func (d upnpDevice) wanService() (upnpService, bool) {
+	for _, s := range d.Services {
+		if strings.HasPrefix(s.ServiceType, wanIPConn) || strings.HasPrefix(s.ServiceType, wanPPPConn) {
+			return s, true
+		}
+	}
+	for _, child := range d.Devices {
+		if s, ok := child.wanService(); ok {
+			return s, true
+		}
+	}
+	return upnpService{}, false
+}
+
+func (u *upnp) resolve(ctx context.Context) error {
+	if u.controlURL != "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.location, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("device description: %s", resp.Status)
+	}
+
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return fmt.Errorf("device description: %w", err)
+	}
+	svc, ok := root.Device.wanService()
+	if !ok {
+		return errors.New("gateway has no WAN connection service")
+	}
+
+	base := u.location
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	control, err := baseURL.Parse(svc.ControlURL)
+	if err != nil {
+		return err
+	}
+	u.controlURL, u.serviceType = control.String(), svc.ServiceType
+	return nil
+}
+
+func (u *upnp) externalIP(ctx context.Context) (net.IP, error) {
+	if err := u.resolve(ctx); err != nil {
+		return nil, err
+	}
+	res, err := u.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(res["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, fmt.Errorf("gateway returned invalid external address %q", res["NewExternalIPAddress"])
+	}
+	return ip, nil
+}
+
+func (u *upnp) addMapping(ctx context.Context, internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	if err := u.resolve(ctx); err != nil {
+		return 0, 0, err
+	}
+	if lifetime == 0 {
+		_, err := u.call(ctx, "DeletePortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(external))},
+			{"NewProtocol", "TCP"},
+		})
+		return 0, 0, err
+	}
+
+	control, err := url.Parse(u.controlURL)
+	if err != nil {
+		return 0, 0, err
+	}
+	local, err := localIPFor(control.Hostname())
+	if err != nil {
+		return 0, 0, err
+	}
+	args := func(lease time.Duration) [][2]string {
+		return [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(external))},
+			{"NewProtocol", "TCP"},
+			{"NewInternalPort", strconv.Itoa(int(internal))},
+			{"NewInternalClient", local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", u.description},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		}
+	}
+
+	_, err = u.call(ctx, "AddPortMapping", args(lifetime))
+	var uerr *UPnPError
+	if errors.As(err, &uerr) && uerr.Code == upnpOnlyPermanentLeases {
+		// the mapping then lives until Close removes it
+		lifetime = 0
+		_, err = u.call(ctx, "AddPortMapping", args(0))
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return external, lifetime, nil
+}
+
+// invokes a SOAP action and returns the response arguments by name
+func (u *upnp) call(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + u.serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.serviceType+"#"+action+`"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	values, err := soapValues(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(values["errorCode"])
+		if code == 0 {
+			return nil, fmt.Errorf("%s: %s", action, resp.Status)
+		}
+		return nil, &UPnPError{Code: code, Description: values["errorDescription"]}
+	}
+	return values, err
+}
+
+// flattens a SOAP response into leaf element names and their text, which is
+// all the IGD actions we use return
+func soapValues(r io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+	dec := xml.NewDecoder(r)
+	var name string
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return values, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if t.Name.Local == name {
+				values[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
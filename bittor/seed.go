@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bittor/peer"
+	"bittor/torfile"
+	"bittor/verify"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+// uploads complete data to the torrent's swarm until interrupted
+func seedCmd(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	port := fs.Uint("port", 0, "peer listen port, first free port from 6881 to 6889 when 0")
+	nat := fs.Bool("nat", false, "forward the listen port with NAT-PMP or UPnP")
+	super := fs.Bool("superseed", false, "reveal pieces one at a time (BEP 16), for the initial seed of new data")
+	uploads := fs.Int("uploads", 0, "peers unchoked at once, 4 when 0")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: bittor seed [flags] <torrent> <path>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 || *port > 65535 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	tf, err := torfile.Read(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	tor := tf.Torrent(peer.NewID())
+	tor.SuperSeed = *super
+	tor.MaxUploads = *uploads
+	if _, err := verify.Resume(ctx, &tf, tor, fs.Arg(1)); err != nil {
+		return err
+	}
+
+	ln, announcePort, closeLn, err := listenPeers(ctx, uint16(*port), *nat)
+	if err != nil {
+		return err
+	}
+	defer closeLn()
+	go tor.Serve(ctx, ln)
+
+	return tf.Seed(ctx, tor, fs.Arg(1), announcePort)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bittor/ban"
+	"bittor/session"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+)
+
+// runs a long lived session driven over the control API
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "", "peer listener address shared by all torrents, first free port from 6881 to 6889 when empty")
+	nat := fs.Bool("nat", false, "forward the listen port with NAT-PMP or UPnP")
+	api := fs.String("api", "127.0.0.1:7070", "control API address, keep it local")
+	maxConns := fs.Int("max-conns", 200, "peer connections across all torrents, 0 is unlimited")
+	banFile := fs.String("ban-file", "", "file banned peers are persisted to")
+	banThreshold := fs.Int("ban-threshold", ban.DefaultThreshold, "hash failures before a peer is banned")
+	blocklist := fs.String("blocklist", "", "P2P or eMule dat IP range blocklist")
+	record := fs.String("record", "", "directory to record peer wire traffic to, one file per connection")
+	maxActive := fs.Int("max-active", 0, "downloads running at once, more wait queued. 0 is unlimited")
+	watch := fs.String("watch", "", "directory polled for .torrent files to add")
+	out := fs.String("out", ".", "directory watched torrents download to")
+	doneDir := fs.String("done", "", "directory completed data is moved to")
+	seedRatio := fs.Float64("seed-ratio", 0, "seed completed torrents until uploading this many times their size, then remove them")
+	seedTime := fs.Duration("seed-time", 0, "seed completed torrents at most this long, then remove them")
+	fs.Parse(args)
+
+	s, err := session.New(session.Config{
+		ListenAddr:   *listen,
+		NAT:          *nat,
+		MaxConns:     *maxConns,
+		BanFile:      *banFile,
+		BanThreshold: *banThreshold,
+		Blocklist:    *blocklist,
+		RecordDir:    *record,
+		MaxActive:    *maxActive,
+		DoneDir:      *doneDir,
+		SeedRatio:    *seedRatio,
+		SeedTime:     *seedTime,
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	srv := &http.Server{Addr: *api, Handler: s.Handler()}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	// a watch folder that can't be read stops the session
+	watchErr := make(chan error, 1)
+	if *watch != "" {
+		go func() {
+			err := s.Watch(ctx, session.WatchConfig{Dir: *watch, OutDir: *out})
+			if err != nil {
+				watchErr <- fmt.Errorf("watching %s: %w", *watch, err)
+				stop()
+			}
+		}()
+	}
+
+	log.Printf("session listening for peers on %d, control api on %s", s.Port(), *api)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	select {
+	case err := <-watchErr:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type addRequest struct {
+	// path of the .torrent file on the session host
+	Torrent string `json:"torrent"`
+	// where downloaded data is written
+	Out string `json:"out"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// Handler serves the JSON control API
+//
+//	GET    /torrents             list torrents
+//	POST   /torrents             add {"torrent": path, "out": path}
+//	GET    /torrents/{id}        torrent info
+//	DELETE /torrents/{id}        stop and remove
+//	POST   /torrents/{id}/pause  pause download
+//	POST   /torrents/{id}/resume resume download
+func (s *Session) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /torrents", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.List())
+	})
+
+	mux.HandleFunc("POST /torrents", func(w http.ResponseWriter, r *http.Request) {
+		var req addRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Torrent == "" || req.Out == "" {
+			writeError(w, http.StatusBadRequest, errors.New("torrent and out are required"))
+			return
+		}
+		info, err := s.Add(req.Torrent, req.Out)
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, info)
+	})
+
+	mux.HandleFunc("GET /torrents/{id}", func(w http.ResponseWriter, r *http.Request) {
+		info, err := s.Get(r.PathValue("id"))
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+
+	mux.HandleFunc("DELETE /torrents/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Remove(r.PathValue("id")); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST /torrents/{id}/pause", func(w http.ResponseWriter, r *http.Request) {
+		info, err := s.Pause(r.PathValue("id"))
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+
+	mux.HandleFunc("POST /torrents/{id}/resume", func(w http.ResponseWriter, r *http.Request) {
+		info, err := s.Resume(r.PathValue("id"))
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+
+	return mux
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrExists):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{err.Error()})
+}
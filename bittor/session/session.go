@@ -0,0 +1,652 @@
+// Package session runs many torrents at once behind one peer listener and
+// one shared connection limit
+package session
+
+import (
+	"bittor/ban"
+	"bittor/client"
+	"bittor/handshake"
+	"bittor/p2p"
+	"bittor/peer"
+	"bittor/portmap"
+	"bittor/torfile"
+	"bittor/verify"
+	"bittor/wire"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type State string
+
+const (
+	StateQueued      State = "queued"
+	StateDownloading State = "downloading"
+	StatePaused      State = "paused"
+	StateCompleted   State = "completed"
+	StateSeeding     State = "seeding"
+	StateFailed      State = "failed"
+)
+
+var (
+	ErrNotFound = errors.New("torrent not found")
+	ErrExists   = errors.New("torrent already added")
+)
+
+type Config struct {
+	// address the shared peer listener binds to, a free port between
+	// portmap.FirstPort and portmap.LastPort when empty
+	ListenAddr string
+	// forward the listen port on the gateway with NAT-PMP or UPnP
+	NAT bool
+	// directory peer connections are recorded to, nothing is recorded when empty
+	RecordDir string
+	// cap on peer connections across all torrents, 0 is unlimited
+	MaxConns int
+	// file bans are persisted to, bans are kept in memory only when empty
+	BanFile string
+	// hash failures before a peer is banned, ban.DefaultThreshold when 0
+	BanThreshold int
+	// optional P2P or eMule dat blocklist
+	Blocklist string
+	// downloads running at once, the rest wait queued. 0 is unlimited
+	MaxActive int
+	// completed data is moved here when set
+	DoneDir string
+	// when either is set completed torrents seed until they uploaded
+	// SeedRatio times their length or seeded for SeedTime, whichever comes
+	// first, and are removed afterwards
+	SeedRatio float64
+	SeedTime  time.Duration
+}
+
+// Info is a snapshot of a managed torrent
+type Info struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	OutPath string `json:"out_path"`
+	State   State  `json:"state"`
+	Length  int    `json:"length"`
+	Pieces  int    `json:"pieces"`
+	Done    int    `json:"done"`
+	Peers   int    `json:"peers"`
+	// bytes per second
+	Rate     float64 `json:"rate"`
+	Uploaded int     `json:"uploaded"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type entry struct {
+	id      string
+	file    torfile.File
+	outPath string
+	// nil until the first announce succeeded
+	tor   *p2p.Torrent
+	state State
+	// queue position, lower starts first
+	seq    uint64
+	err    error
+	cancel context.CancelFunc
+	// closed when the running download goroutine exits
+	done chan struct{}
+}
+
+type Session struct {
+	cfg     Config
+	peerID  [20]byte
+	port    uint16
+	limiter *p2p.Limiter
+	bans    *ban.List
+	ln      net.Listener
+	rec     *wire.Recorder
+	// nil until the gateway granted a mapping
+	mapping atomic.Pointer[portmap.Mapping]
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	torrents map[string]*entry
+	seq      uint64
+}
+
+// New starts the shared peer listener. Torrents are added with Add
+func New(cfg Config) (*Session, error) {
+	if cfg.DoneDir != "" {
+		if err := os.MkdirAll(cfg.DoneDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	bans, err := openBans(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec *wire.Recorder
+	if cfg.RecordDir != "" {
+		if rec, err = wire.NewRecorder(cfg.RecordDir); err != nil {
+			bans.Close()
+			return nil, err
+		}
+	}
+
+	var ln net.Listener
+	if cfg.ListenAddr == "" {
+		ln, err = portmap.Listen(0)
+	} else {
+		ln, err = net.Listen("tcp", cfg.ListenAddr)
+	}
+	if err != nil {
+		bans.Close()
+		return nil, err
+	}
+
+	s := &Session{
+		cfg:      cfg,
+		peerID:   peer.NewID(),
+		port:     portmap.ListenPort(ln),
+		bans:     bans,
+		ln:       ln,
+		rec:      rec,
+		torrents: map[string]*entry{},
+	}
+	if cfg.MaxConns > 0 {
+		s.limiter = p2p.NewLimiter(cfg.MaxConns)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+	if cfg.NAT {
+		s.wg.Add(1)
+		go s.mapPort()
+	}
+	return s, nil
+}
+
+// port the shared listener is bound to
+func (s *Session) Port() uint16 {
+	return s.port
+}
+
+// port handed to trackers, the gateway may have forwarded another one
+func (s *Session) announcePort() uint16 {
+	if m := s.mapping.Load(); m != nil {
+		return m.ExternalPort()
+	}
+	return s.port
+}
+
+// discovery can take a few seconds, torrents announce the listen port
+// until a mapping is in place
+func (s *Session) mapPort() {
+	defer s.wg.Done()
+	m, err := portmap.Map(s.ctx, portmap.Config{}, s.port)
+	if err != nil {
+		log.Printf("port mapping failed: %v", err)
+		return
+	}
+	log.Printf("port mapped: %s", m)
+	s.mapping.Store(m)
+}
+
+// Add reads a .torrent file and queues it for download to outPath, it
+// starts right away unless Config.MaxActive downloads are running
+func (s *Session) Add(torrentPath, outPath string) (Info, error) {
+	tf, err := torfile.Read(torrentPath)
+	if err != nil {
+		return Info{}, err
+	}
+	return s.add(tf, outPath)
+}
+
+func (s *Session) add(tf torfile.File, outPath string) (Info, error) {
+	e := &entry{
+		id:      hex.EncodeToString(tf.InfoHash[:]),
+		file:    tf,
+		outPath: outPath,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.torrents[e.id]; ok {
+		return Info{}, ErrExists
+	}
+	s.torrents[e.id] = e
+	s.enqueue(e)
+	return e.info(), nil
+}
+
+// Remove stops a torrent and forgets it, downloaded data is not deleted
+func (s *Session) Remove(id string) error {
+	s.mu.Lock()
+	e, ok := s.torrents[id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	delete(s.torrents, id)
+	s.mu.Unlock()
+
+	s.stop(e)
+
+	s.mu.Lock()
+	s.schedule()
+	s.mu.Unlock()
+	return nil
+}
+
+// Pause stops or dequeues a download but keeps verified pieces for Resume
+func (s *Session) Pause(id string) (Info, error) {
+	s.mu.Lock()
+	e, ok := s.torrents[id]
+	if !ok {
+		s.mu.Unlock()
+		return Info{}, ErrNotFound
+	}
+	if e.state != StateDownloading && e.state != StateQueued {
+		s.mu.Unlock()
+		return Info{}, fmt.Errorf("cannot pause torrent in state %s", e.state)
+	}
+	e.state = StatePaused
+	s.mu.Unlock()
+
+	s.stop(e)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule()
+	return e.info(), nil
+}
+
+// Resume queues a paused or failed download again
+func (s *Session) Resume(id string) (Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.torrents[id]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	if e.state != StatePaused && e.state != StateFailed {
+		return Info{}, fmt.Errorf("cannot resume torrent in state %s", e.state)
+	}
+	if e.running() {
+		return Info{}, fmt.Errorf("torrent is still stopping")
+	}
+	s.enqueue(e)
+	return e.info(), nil
+}
+
+func (s *Session) Get(id string) (Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.torrents[id]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	return e.info(), nil
+}
+
+func (s *Session) List() []Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]Info, 0, len(s.torrents))
+	for _, e := range s.torrents {
+		infos = append(infos, e.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Close stops every torrent and the peer listener
+func (s *Session) Close() error {
+	s.cancel()
+	err := s.ln.Close()
+
+	s.mu.Lock()
+	entries := make([]*entry, 0, len(s.torrents))
+	for _, e := range s.torrents {
+		entries = append(entries, e)
+	}
+	s.mu.Unlock()
+
+	for _, e := range entries {
+		s.stop(e)
+	}
+	s.wg.Wait()
+	if m := s.mapping.Load(); m != nil {
+		if merr := m.Close(); merr != nil {
+			log.Printf("removing port mapping failed: %v", merr)
+		}
+	}
+	if berr := s.bans.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
+
+func openBans(cfg Config) (*ban.List, error) {
+	threshold := cfg.BanThreshold
+	if threshold <= 0 {
+		threshold = ban.DefaultThreshold
+	}
+
+	bans := ban.New(threshold)
+	if cfg.BanFile != "" {
+		var err error
+		if bans, err = ban.Open(cfg.BanFile, threshold); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Blocklist != "" {
+		n, err := bans.LoadBlocklist(cfg.Blocklist)
+		if err != nil {
+			bans.Close()
+			return nil, err
+		}
+		log.Printf("loaded %d blocked ranges from %s", n, cfg.Blocklist)
+	}
+	return bans, nil
+}
+
+// puts e at the back of the queue, caller holds s.mu
+func (s *Session) enqueue(e *entry) {
+	s.seq++
+	e.state, e.err, e.seq = StateQueued, nil, s.seq
+	s.schedule()
+}
+
+// starts queued torrents in order while there are free download slots,
+// caller holds s.mu
+func (s *Session) schedule() {
+	if s.ctx.Err() != nil {
+		return
+	}
+	active := 0
+	var queued []*entry
+	for _, e := range s.torrents {
+		switch e.state {
+		case StateDownloading:
+			active++
+		case StateQueued:
+			queued = append(queued, e)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].seq < queued[j].seq })
+	for _, e := range queued {
+		if s.cfg.MaxActive > 0 && active >= s.cfg.MaxActive {
+			return
+		}
+		s.start(e)
+		active++
+	}
+}
+
+// starts download goroutine, caller holds s.mu
+func (s *Session) start(e *entry) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	e.state, e.err = StateDownloading, nil
+	e.cancel, e.done = cancel, make(chan struct{})
+
+	s.wg.Add(1)
+	go s.run(ctx, e, e.done)
+}
+
+// cancels a running download and waits for it to exit
+func (s *Session) stop(e *entry) {
+	s.mu.Lock()
+	cancel, done := e.cancel, e.done
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (s *Session) run(ctx context.Context, e *entry, done chan struct{}) {
+	defer s.wg.Done()
+	defer close(done)
+
+	err := s.download(ctx, e)
+
+	s.mu.Lock()
+	// paused or removed while running, state was already set by the caller
+	if e.state != StateDownloading {
+		s.mu.Unlock()
+		return
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// session closing
+			e.state = StatePaused
+		} else {
+			log.Printf("torrent %s failed: %v", e.file.Name, err)
+			e.state, e.err = StateFailed, err
+		}
+		s.schedule()
+		s.mu.Unlock()
+		return
+	}
+	log.Printf("torrent %s completed", e.file.Name)
+	e.state = StateCompleted
+	// seeding doesn't take a download slot
+	s.schedule()
+	s.mu.Unlock()
+
+	s.finish(ctx, e)
+}
+
+// moves completed data to Config.DoneDir and seeds it to the configured
+// ratio or time, then removes e
+func (s *Session) finish(ctx context.Context, e *entry) {
+	if s.cfg.DoneDir != "" {
+		to := filepath.Join(s.cfg.DoneDir, filepath.Base(e.outPath))
+		// earlier data of the same name is kept
+		if _, err := os.Stat(to); err == nil {
+			to = filepath.Join(s.cfg.DoneDir, tagName(filepath.Base(e.outPath), e.file.InfoHash))
+		}
+		if err := moveFile(e.outPath, to); err != nil {
+			log.Printf("moving %s to %s failed: %v", e.outPath, to, err)
+			s.mu.Lock()
+			e.err = err
+			s.mu.Unlock()
+			return
+		}
+		log.Printf("moved %s to %s", e.outPath, to)
+		s.mu.Lock()
+		e.outPath = to
+		s.mu.Unlock()
+	}
+	if s.cfg.SeedRatio <= 0 && s.cfg.SeedTime <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	if e.state != StateCompleted {
+		s.mu.Unlock()
+		return
+	}
+	e.state = StateSeeding
+	tor, path := e.tor, e.outPath
+	s.mu.Unlock()
+
+	err := s.seed(ctx, e, tor, path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.state != StateSeeding {
+		return
+	}
+	if err != nil {
+		log.Printf("seeding %s failed: %v", e.file.Name, err)
+		e.state, e.err = StateCompleted, err
+		return
+	}
+	if ctx.Err() != nil {
+		// session closing, the torrent stays listed as completed
+		e.state = StateCompleted
+		return
+	}
+	log.Printf("torrent %s done seeding, uploaded %d bytes", e.file.Name, tor.Stats().Uploaded)
+	delete(s.torrents, e.id)
+}
+
+// seeds until the ratio or time target is met or ctx is done
+func (s *Session) seed(ctx context.Context, e *entry, tor *p2p.Torrent, path string) error {
+	if s.cfg.SeedTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.SeedTime)
+		defer cancel()
+	}
+	if s.cfg.SeedRatio > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		target := int(s.cfg.SeedRatio * float64(e.file.Length))
+		go func() {
+			tick := time.NewTicker(time.Second)
+			defer tick.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick.C:
+					if tor.Stats().Uploaded >= target {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+	return e.file.Seed(ctx, tor, path, s.announcePort())
+}
+
+func (s *Session) download(ctx context.Context, e *entry) error {
+	s.mu.Lock()
+	tor := e.tor
+	s.mu.Unlock()
+
+	if tor == nil {
+		var err error
+		if tor, err = e.file.NewTorrent(ctx, s.peerID, s.announcePort()); err != nil {
+			return err
+		}
+		tor.Limiter = s.limiter
+		tor.Bans = s.bans
+		tor.Recorder = s.rec
+		// pick up pieces an earlier session already wrote
+		if _, err := verify.Resume(ctx, &e.file, tor, e.outPath); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		e.tor = tor
+		s.mu.Unlock()
+	}
+
+	return e.file.DownloadTo(ctx, tor, e.outPath, s.announcePort())
+}
+
+// reports whether another torrent writes to path
+func (s *Session) pathInUse(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.torrents {
+		if e.outPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+// reports whether the download goroutine has not exited yet
+func (e *entry) running() bool {
+	if e.done == nil {
+		return false
+	}
+	select {
+	case <-e.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// info snapshot, caller holds s.mu
+func (e *entry) info() Info {
+	info := Info{
+		ID:      e.id,
+		Name:    e.file.Name,
+		OutPath: e.outPath,
+		State:   e.state,
+		Length:  e.file.Length,
+		Pieces:  len(e.file.PieceHashes),
+	}
+	if e.tor != nil {
+		st := e.tor.Stats()
+		info.Done, info.Peers, info.Rate, info.Uploaded = st.Done, st.Peers, st.Rate, st.Uploaded
+	}
+	if e.err != nil {
+		info.Error = e.err.Error()
+	}
+	return info
+}
+
+// routes incoming peer connections to their torrent by info hash
+func (s *Session) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("peer listener stopped: %v", err)
+			}
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Session) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	hs, err := handshake.Read(conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && s.bans.Banned(addr.IP) {
+		conn.Close()
+		return
+	}
+
+	s.mu.Lock()
+	var tor *p2p.Torrent
+	if e, ok := s.torrents[hex.EncodeToString(hs.InfoHash[:])]; ok && (e.state == StateDownloading || e.state == StateSeeding) {
+		tor = e.tor
+	}
+	s.mu.Unlock()
+	if tor == nil {
+		conn.Close()
+		return
+	}
+
+	c, err := client.Accept(s.rec.Wrap(conn, hs), hs, s.peerID, tor.Bitfield())
+	if err != nil {
+		return
+	}
+	if !tor.AddClient(c) {
+		c.Close()
+	}
+}
@@ -0,0 +1,220 @@
+package session
+
+import (
+	"bittor/torfile"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const DefaultWatchInterval = 5 * time.Second
+
+// watched files are renamed once added, so a restarted watcher doesn't
+// pick them up again
+const addedSuffix = ".added"
+
+type WatchConfig struct {
+	// directory polled for .torrent files
+	Dir string
+	// downloads are written to OutDir/<torrent name>
+	OutDir string
+	// time between polls, DefaultWatchInterval when 0
+	Interval time.Duration
+}
+
+// Watch polls cfg.Dir until ctx is done and adds every .torrent file dropped
+// into it. A file is only read once its size and modification time held
+// still for a poll, so files still being copied in are left alone. Added
+// files are renamed to .torrent.added, unreadable ones are retried once
+// they change
+func (s *Session) Watch(ctx context.Context, cfg WatchConfig) error {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultWatchInterval
+	}
+	if err := os.MkdirAll(cfg.OutDir, 0o755); err != nil {
+		return err
+	}
+	w := &watcher{s: s, cfg: cfg, pending: map[string]os.FileInfo{}, failed: map[string]os.FileInfo{}, handled: map[string]bool{}}
+	if err := w.poll(); err != nil {
+		return err
+	}
+	log.Printf("watching %s for torrents", cfg.Dir)
+
+	tick := time.NewTicker(cfg.Interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+			if err := w.poll(); err != nil {
+				log.Printf("watching %s: %v", cfg.Dir, err)
+			}
+		}
+	}
+}
+
+type watcher struct {
+	s   *Session
+	cfg WatchConfig
+	// last seen state of files not added yet
+	pending map[string]os.FileInfo
+	// state of files that didn't parse, skipped until they change
+	failed map[string]os.FileInfo
+	// files handled but not renamed, skipped from then on
+	handled map[string]bool
+}
+
+func (w *watcher) poll() error {
+	entries, err := os.ReadDir(w.cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, de := range entries {
+		name := de.Name()
+		if !de.Type().IsRegular() || !strings.EqualFold(filepath.Ext(name), ".torrent") || w.handled[name] {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			// removed since the listing
+			continue
+		}
+		seen[name] = true
+		if bad, ok := w.failed[name]; ok && sameFile(bad, fi) {
+			continue
+		}
+		delete(w.failed, name)
+		prev, ok := w.pending[name]
+		w.pending[name] = fi
+		if !ok || !sameFile(prev, fi) {
+			continue
+		}
+		delete(w.pending, name)
+		w.add(name, fi)
+	}
+	for name := range w.pending {
+		if !seen[name] {
+			delete(w.pending, name)
+		}
+	}
+	for name := range w.failed {
+		if !seen[name] {
+			delete(w.failed, name)
+		}
+	}
+	return nil
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+func (w *watcher) add(name string, fi os.FileInfo) {
+	path := filepath.Join(w.cfg.Dir, name)
+	tf, err := torfile.Read(path)
+	if err != nil {
+		log.Printf("skipping %s until it changes: %v", path, err)
+		w.failed[name] = fi
+		return
+	}
+
+	out := filepath.Join(w.cfg.OutDir, outName(tf))
+	if w.s.pathInUse(out) {
+		out = filepath.Join(w.cfg.OutDir, tagName(outName(tf), tf.InfoHash))
+	}
+	switch _, err := w.s.add(tf, out); {
+	case errors.Is(err, ErrExists):
+		log.Printf("skipping %s: %v", path, err)
+	case err != nil:
+		log.Printf("adding %s failed: %v", path, err)
+		return
+	default:
+		log.Printf("added %s, downloading to %s", path, out)
+	}
+	if err := os.Rename(path, path+addedSuffix); err != nil {
+		log.Printf("renaming %s failed: %v", path, err)
+		w.handled[name] = true
+	}
+}
+
+// file name downloaded data is written to, the torrent's name can't step
+// out of the output directory
+func outName(tf torfile.File) string {
+	name := filepath.Base(filepath.Clean("/" + tf.Name))
+	if name == "." || name == string(filepath.Separator) {
+		return hex.EncodeToString(tf.InfoHash[:])
+	}
+	return name
+}
+
+// keeps torrents sharing a name apart, the short info hash goes before
+// the extension
+func tagName(name string, infoHash [20]byte) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + hex.EncodeToString(infoHash[:4]) + ext
+}
+
+// renames from to to, copying when they are on different filesystems.
+// from is a file or, for multi file torrents, a directory tree
+func moveFile(from, to string) error {
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	// copied next to the target first so a failed copy leaves no partial data
+	part := to + ".part"
+	if err := copyTree(from, part); err != nil {
+		os.RemoveAll(part)
+		return err
+	}
+	if err := os.Rename(part, to); err != nil {
+		os.RemoveAll(part)
+		return err
+	}
+	return os.RemoveAll(from)
+}
+
+func copyTree(from, to string) error {
+	return filepath.WalkDir(from, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(to, rel)
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0o755)
+		}
+		return copyFile(path, dst)
+	})
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
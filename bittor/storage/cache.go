@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"slices"
+	"sync"
+)
+
+// DefaultCacheSize is how much written data a Cache holds before flushing
+const DefaultCacheSize = 16 << 20
+
+// a pending write
+type extent struct {
+	off  int64
+	data []byte
+}
+
+func (e extent) end() int64 {
+	return e.off + int64(len(e.data))
+}
+
+// Cache buffers writes in memory and flushes them to the underlying storage
+// sorted by offset, with adjacent writes merged into one. Pieces completing
+// out of order still reach the disk as large sequential writes
+type Cache struct {
+	s      Storage
+	layout Layout
+	max    int
+
+	mu      sync.Mutex
+	pending []extent
+	size    int
+}
+
+// NewCache wraps s, flushing once max bytes are pending. DefaultCacheSize
+// when max is 0
+func NewCache(s Storage, l Layout, max int) *Cache {
+	if max <= 0 {
+		max = DefaultCacheSize
+	}
+	return &Cache{s: s, layout: l, max: max}
+}
+
+func (c *Cache) WriteAt(p []byte, off int64) (int, error) {
+	// rejected now, a bad extent would otherwise fail every later flush
+	if err := checkRange(c.layout, len(p), off); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// rewrites are rare (a piece that failed after being stored), flushing
+	// first keeps pending extents disjoint
+	for _, e := range c.pending {
+		if off < e.end() && e.off < off+int64(len(p)) {
+			if err := c.flushLocked(); err != nil {
+				return 0, err
+			}
+			break
+		}
+	}
+
+	c.pending = append(c.pending, extent{off: off, data: slices.Clone(p)})
+	c.size += len(p)
+	if c.size >= c.max {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// ReadAt reads from the underlying storage with pending writes laid over
+// it. Storages are sized to the payload up front so pending writes never
+// extend past what the underlying read returned
+func (c *Cache) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, err := c.s.ReadAt(p, off)
+	for _, e := range c.pending {
+		lo, hi := max(off, e.off), min(off+int64(n), e.end())
+		if lo < hi {
+			copy(p[lo-off:hi-off], e.data[lo-e.off:])
+		}
+	}
+	return n, err
+}
+
+// Hash reads piece idx back like ReadAt, pending writes aren't flushed for
+// it so checking every stored piece keeps writes coalesced
+func (c *Cache) Hash(idx int) ([20]byte, error) {
+	return hashPiece(c, c.layout, idx)
+}
+
+// Flush writes all pending data to the underlying storage
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *Cache) flushLocked() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	slices.SortFunc(c.pending, func(a, b extent) int {
+		switch {
+		case a.off < b.off:
+			return -1
+		case a.off > b.off:
+			return 1
+		}
+		return 0
+	})
+
+	for i := 0; i < len(c.pending); {
+		run := c.pending[i]
+		j := i + 1
+		// merge extents that continue where the run ends
+		if j < len(c.pending) && c.pending[j].off == run.end() {
+			buf := slices.Clone(run.data)
+			for ; j < len(c.pending) && c.pending[j].off == run.off+int64(len(buf)); j++ {
+				buf = append(buf, c.pending[j].data...)
+			}
+			run.data = buf
+		}
+		if _, err := c.s.WriteAt(run.data, run.off); err != nil {
+			// keep what wasn't written for a later attempt
+			c.pending = slices.Delete(c.pending, 0, i)
+			c.size = 0
+			for _, e := range c.pending {
+				c.size += len(e.data)
+			}
+			return err
+		}
+		i = j
+	}
+	c.pending, c.size = c.pending[:0], 0
+	return nil
+}
+
+func (c *Cache) Sync() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	return c.s.Sync()
+}
+
+func (c *Cache) Close() error {
+	err := c.Flush()
+	if cerr := c.s.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
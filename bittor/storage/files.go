@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileSpan is one file of the payload, files follow each other in payload
+// order
+type FileSpan struct {
+	Path   string
+	Length int64
+}
+
+var errReadOnly = errors.New("storage opened read only")
+
+// Files stores the payload spread over the torrent's files, the way other
+// clients lay it out: a single file torrent is one file, a multi file
+// torrent a directory tree
+type Files struct {
+	files    []FileSpan
+	layout   Layout
+	readOnly bool
+
+	mu      sync.Mutex
+	handles map[int]*os.File
+	closed  bool
+}
+
+// OpenFiles creates the files and their directories as needed and sizes
+// each file to its length
+func OpenFiles(files []FileSpan, l Layout) (*Files, error) {
+	s := &Files{files: files, layout: l, handles: map[int]*os.File{}}
+	for i, span := range files {
+		if err := os.MkdirAll(filepath.Dir(span.Path), 0o755); err != nil {
+			s.Close()
+			return nil, err
+		}
+		f, err := os.OpenFile(span.Path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles[i] = f
+		if err := f.Truncate(span.Length); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ReadFiles opens existing data for reading, e.g. to verify or seed it.
+// Files are opened on first use and nothing is created, reads from a
+// missing file fail with an error matching os.ErrNotExist
+func ReadFiles(files []FileSpan, l Layout) *Files {
+	return &Files{files: files, layout: l, readOnly: true, handles: map[int]*os.File{}}
+}
+
+func (s *Files) open(i int) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.handles[i]; ok {
+		return f, nil
+	}
+	// writable files are all opened up front
+	if s.closed || !s.readOnly {
+		return nil, os.ErrClosed
+	}
+	f, err := os.Open(s.files[i].Path)
+	if err != nil {
+		return nil, err
+	}
+	s.handles[i] = f
+	return f, nil
+}
+
+// Exists reports whether file i is on disk
+func (s *Files) Exists(i int) bool {
+	_, err := s.open(i)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// runs fn over the parts of the payload range [off, off+n) in each file,
+// with the offset into the file and the range of p it covers
+func (s *Files) spans(n int, off int64, fn func(i int, pos int64, from, to int) error) (int, error) {
+	done := 0
+	start := int64(0)
+	for i, span := range s.files {
+		end := start + span.Length
+		pos := off + int64(done)
+		if done < n && pos >= start && pos < end {
+			want := int(min(int64(n-done), end-pos))
+			if err := fn(i, pos-start, done, done+want); err != nil {
+				return done, err
+			}
+			done += want
+		}
+		start = end
+	}
+	return done, nil
+}
+
+func (s *Files) ReadAt(p []byte, off int64) (int, error) {
+	n, err := s.spans(len(p), off, func(i int, pos int64, from, to int) error {
+		// open errors name the file already
+		f, err := s.open(i)
+		if err != nil {
+			return err
+		}
+		read, err := f.ReadAt(p[from:to], pos)
+		if err != nil && read < to-from {
+			return fmt.Errorf("%s: %w", s.files[i].Path, err)
+		}
+		return nil
+	})
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *Files) WriteAt(p []byte, off int64) (int, error) {
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+	if err := checkRange(s.layout, len(p), off); err != nil {
+		return 0, err
+	}
+	return s.spans(len(p), off, func(i int, pos int64, from, to int) error {
+		f, err := s.open(i)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(p[from:to], pos)
+		return err
+	})
+}
+
+func (s *Files) Hash(idx int) ([20]byte, error) {
+	return hashPiece(s, s.layout, idx)
+}
+
+func (s *Files) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return nil
+	}
+	for _, f := range s.handles {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Files) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for i, f := range s.handles {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		delete(s.handles, i)
+	}
+	s.closed = true
+	return err
+}
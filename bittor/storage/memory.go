@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"io"
+	"sync"
+)
+
+// Memory keeps the payload in a byte slice, for small torrents and callers
+// that want the assembled data back
+type Memory struct {
+	layout Layout
+
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemory(l Layout) *Memory {
+	return &Memory{layout: l, data: make([]byte, l.Length)}
+}
+
+// Bytes returns the payload, it must not be modified while writes are pending
+func (s *Memory) Bytes() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data
+}
+
+func (s *Memory) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if off < 0 || off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *Memory) WriteAt(p []byte, off int64) (int, error) {
+	if err := checkRange(s.layout, len(p), off); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copy(s.data[off:], p), nil
+}
+
+func (s *Memory) Hash(idx int) ([20]byte, error) {
+	return hashPiece(s, s.layout, idx)
+}
+
+func (s *Memory) Sync() error {
+	return nil
+}
+
+func (s *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package storage
+
+import (
+	"errors"
+)
+
+// Mmap is only available on unix, OpenMmap always fails elsewhere
+type Mmap struct {
+	File
+}
+
+func OpenMmap(path string, l Layout) (*Mmap, error) {
+	return nil, errors.New("mmap storage is not supported on this platform")
+}
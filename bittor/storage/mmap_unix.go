@@ -0,0 +1,117 @@
+//go:build unix
+
+package storage
+
+import (
+	"crypto/sha1"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Mmap maps the payload file into memory, reads and writes are plain copies
+// and the kernel writes dirty pages back
+type Mmap struct {
+	f      *os.File
+	layout Layout
+
+	// guards data against use after Close
+	mu   sync.RWMutex
+	data []byte
+}
+
+func OpenMmap(path string, l Layout) (*Mmap, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(l.Length)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &Mmap{f: f, layout: l}
+	// zero length files can't be mapped
+	if l.Length > 0 {
+		s.data, err = syscall.Mmap(int(f.Fd()), 0, l.Length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+var errMmapClosed = errors.New("mmap storage closed")
+
+func (s *Mmap) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.f == nil {
+		return 0, errMmapClosed
+	}
+	if off < 0 || off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *Mmap) WriteAt(p []byte, off int64) (int, error) {
+	if err := checkRange(s.layout, len(p), off); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.f == nil {
+		return 0, errMmapClosed
+	}
+	return copy(s.data[off:], p), nil
+}
+
+// hashes straight from the mapping without copying
+func (s *Mmap) Hash(idx int) ([20]byte, error) {
+	if idx < 0 || idx >= s.layout.Pieces() {
+		return hashPiece(s, s.layout, idx)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.f == nil {
+		return [20]byte{}, errMmapClosed
+	}
+	begin, end := s.layout.Bounds(idx)
+	return sha1.Sum(s.data[begin:end]), nil
+}
+
+// on linux fsync also writes back dirty pages of shared mappings
+func (s *Mmap) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.f == nil {
+		return errMmapClosed
+	}
+	return s.f.Sync()
+}
+
+func (s *Mmap) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	var err error
+	if s.data != nil {
+		err = syscall.Munmap(s.data)
+		s.data = nil
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	return err
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultIOWorkers is the number of goroutines doing disk I/O per Pool
+const DefaultIOWorkers = 4
+
+// ErrPoolClosed is passed to the callback of jobs submitted after Close
+var ErrPoolClosed = errors.New("storage pool closed")
+
+// Pool runs storage operations on a fixed number of workers. Callers hand
+// over a job and get the result through a callback on the worker goroutine,
+// the queue is bounded so a slow disk pushes back on the producer instead
+// of buffering without limit
+type Pool struct {
+	s    Storage
+	jobs chan func()
+	wg   sync.WaitGroup
+
+	// held for reading while submitting so Close can't close jobs under a sender
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewPool starts workers for s with room for queue waiting jobs. Defaults
+// are used for values <= 0
+func NewPool(s Storage, workers, queue int) *Pool {
+	if workers <= 0 {
+		workers = DefaultIOWorkers
+	}
+	if queue <= 0 {
+		queue = 4 * workers
+	}
+	p := &Pool{s: s, jobs: make(chan func(), queue)}
+	p.wg.Add(workers)
+	for range workers {
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// queues job, or runs closed right away once the pool was closed
+func (p *Pool) submit(job, closed func()) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		closed()
+		return
+	}
+	p.jobs <- job
+}
+
+// like submit but gives up instead of waiting for room in the queue
+func (p *Pool) trySubmit(job, closed func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		closed()
+		return true
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Read fills buf from off, e.g. to answer a peer's block request
+func (p *Pool) Read(buf []byte, off int64, done func(int, error)) {
+	p.submit(func() {
+		done(p.s.ReadAt(buf, off))
+	}, func() { done(0, ErrPoolClosed) })
+}
+
+// TryWritePiece stores buf, all of piece idx, at off and reads the piece
+// back, done gets the hash of what the storage returned. buf must not be
+// modified until then. It doesn't wait for room in the queue, false means
+// the job wasn't taken and done won't be called
+func (p *Pool) TryWritePiece(idx int, buf []byte, off int64, done func([20]byte, error)) bool {
+	return p.trySubmit(func() {
+		if _, err := p.s.WriteAt(buf, off); err != nil {
+			done([20]byte{}, err)
+			return
+		}
+		done(p.s.Hash(idx))
+	}, func() { done([20]byte{}, ErrPoolClosed) })
+}
+
+// Close runs the queued jobs and stops the workers. Jobs submitted later
+// fail with ErrPoolClosed
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.jobs)
+	p.mu.Unlock()
+	p.wg.Wait()
+}
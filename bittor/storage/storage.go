@@ -0,0 +1,64 @@
+// Package storage keeps torrent payload on disk or in memory. Piece data is
+// written through a Cache that coalesces adjacent writes and a Pool of I/O
+// workers, so peer goroutines never wait on the disk
+package storage
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+)
+
+// Storage holds the payload of a torrent as one contiguous byte range
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	// Hash reads piece idx back and returns its SHA-1
+	Hash(idx int) ([20]byte, error)
+	// Sync flushes written data to stable storage
+	Sync() error
+	Close() error
+}
+
+// Layout describes how the payload is split into pieces
+type Layout struct {
+	PieceLength int
+	Length      int
+}
+
+func (l Layout) Pieces() int {
+	if l.PieceLength <= 0 {
+		return 0
+	}
+	return (l.Length + l.PieceLength - 1) / l.PieceLength
+}
+
+// Bounds returns the payload range of piece idx
+func (l Layout) Bounds(idx int) (begin, end int64) {
+	begin = int64(idx) * int64(l.PieceLength)
+	end = min(begin+int64(l.PieceLength), int64(l.Length))
+	return begin, end
+}
+
+// hashes piece idx as read from r
+func hashPiece(r io.ReaderAt, l Layout, idx int) ([20]byte, error) {
+	if idx < 0 || idx >= l.Pieces() {
+		return [20]byte{}, fmt.Errorf("piece %d out of range", idx)
+	}
+	begin, end := l.Bounds(idx)
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, begin, end-begin)); err != nil {
+		return [20]byte{}, fmt.Errorf("reading piece %d: %w", idx, err)
+	}
+	var sum [20]byte
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+// checks a request against the payload size
+func checkRange(l Layout, n int, off int64) error {
+	if off < 0 || off+int64(n) > int64(l.Length) {
+		return fmt.Errorf("range %d+%d outside payload of %d bytes", off, n, l.Length)
+	}
+	return nil
+}
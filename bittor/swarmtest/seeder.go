@@ -0,0 +1,233 @@
+package swarmtest
+
+import (
+	"bittor/bitfield"
+	"bittor/handshake"
+	"bittor/message"
+	"bittor/peer"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Behavior int
+
+const (
+	// serves every request correctly
+	Honest Behavior = iota
+	// waits Delay before each block
+	Slow
+	// serves blocks with flipped bytes so pieces fail their hash
+	Corrupt
+	// never unchokes, requests are ignored
+	Choking
+)
+
+func (b Behavior) String() string {
+	switch b {
+	case Honest:
+		return "honest"
+	case Slow:
+		return "slow"
+	case Corrupt:
+		return "corrupt"
+	case Choking:
+		return "choking"
+	default:
+		return fmt.Sprintf("Behavior(%d)", int(b))
+	}
+}
+
+// SeederConfig describes one peer of the swarm
+type SeederConfig struct {
+	Behavior Behavior
+	// per block delay of Slow seeders, 200ms when 0
+	Delay time.Duration
+	// pieces the seeder has, all of them when nil
+	Pieces []int
+}
+
+// Seeder is an in process peer serving a torrent's data on loopback
+type Seeder struct {
+	Config SeederConfig
+	Peer   peer.Peer
+
+	infoHash    [20]byte
+	peerID      [20]byte
+	data        []byte
+	pieceLength int
+	have        bitfield.Bitfield
+	ln          net.Listener
+
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+
+	uploaded atomic.Int64
+	accepted atomic.Int64
+}
+
+// listens on ip, another loopback address per seeder keeps bans and blame
+// on one seeder from hitting the others
+func newSeeder(ip net.IP, cfg SeederConfig, infoHash [20]byte, data []byte, pieceLength int) (*Seeder, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		// only linux routes all of 127/8 to loopback
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Behavior == Slow && cfg.Delay == 0 {
+		cfg.Delay = 200 * time.Millisecond
+	}
+
+	pieces := (len(data) + pieceLength - 1) / pieceLength
+	have := make(bitfield.Bitfield, (pieces+7)/8)
+	if cfg.Pieces == nil {
+		for i := range pieces {
+			have.SetPiece(i)
+		}
+	}
+	for _, i := range cfg.Pieces {
+		have.SetPiece(i)
+	}
+
+	addr := ln.Addr().(*net.TCPAddr)
+	s := &Seeder{
+		Config:      cfg,
+		Peer:        peer.Peer{IP: addr.IP, Port: uint16(addr.Port)},
+		infoHash:    infoHash,
+		peerID:      peer.NewID(),
+		data:        data,
+		pieceLength: pieceLength,
+		have:        have,
+		ln:          ln,
+		conns:       map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Uploaded is the number of block bytes sent
+func (s *Seeder) Uploaded() int64 {
+	return s.uploaded.Load()
+}
+
+// Accepted is the number of connections that completed a handshake
+func (s *Seeder) Accepted() int64 {
+	return s.accepted.Load()
+}
+
+// Close stops listening and drops every connection
+func (s *Seeder) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Seeder) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (s *Seeder) serve(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	hs, err := handshake.Read(conn)
+	if err != nil || hs.InfoHash != s.infoHash {
+		return
+	}
+	res := handshake.New(s.infoHash, s.peerID)
+	if _, err := conn.Write(res.Serialize()); err != nil {
+		return
+	}
+	bf := message.Message{ID: message.MsgBitfield, Payload: s.have}
+	if _, err := conn.Write(bf.Serialize()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.accepted.Add(1)
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgInterested:
+			if s.Config.Behavior == Choking {
+				continue
+			}
+			unchoke := message.Message{ID: message.MsgUnchoke}
+			if _, err := conn.Write(unchoke.Serialize()); err != nil {
+				return
+			}
+		case message.MsgRequest:
+			if s.Config.Behavior == Choking || len(msg.Payload) != 12 {
+				continue
+			}
+			block, ok := s.block(msg.Payload)
+			if !ok {
+				// a real peer would drop us for asking out of range
+				return
+			}
+			if s.Config.Behavior == Slow {
+				time.Sleep(s.Config.Delay)
+			}
+			if _, err := conn.Write(block.Serialize()); err != nil {
+				return
+			}
+			s.uploaded.Add(int64(len(block.Payload) - 8))
+		}
+	}
+}
+
+// builds the piece message answering a request payload
+func (s *Seeder) block(req []byte) (message.Message, bool) {
+	idx := int(binary.BigEndian.Uint32(req))
+	begin := int(binary.BigEndian.Uint32(req[4:]))
+	length := int(binary.BigEndian.Uint32(req[8:]))
+	off := idx*s.pieceLength + begin
+	if !s.have.HasPiece(idx) || begin < 0 || length <= 0 || begin+length > s.pieceLength || off+length > len(s.data) {
+		return message.Message{}, false
+	}
+
+	payload := make([]byte, 8+length)
+	copy(payload, req[:8])
+	copy(payload[8:], s.data[off:off+length])
+	if s.Config.Behavior == Corrupt {
+		for i := 8; i < len(payload); i += 512 {
+			payload[i] ^= 0xff
+		}
+	}
+	return message.Message{ID: message.MsgPiece, Payload: payload}, true
+}
@@ -0,0 +1,138 @@
+// Package swarmtest runs a tracker stand-in and seeding peers in process on
+// loopback, so the whole download path (announce, handshake, bitfield,
+// request/piece, integrity checks) can be exercised without the internet.
+// Seeders can be slow, lie with corrupt data or keep us choked
+package swarmtest
+
+import (
+	"bittor/bencode"
+	"bittor/p2p"
+	"bittor/peer"
+	"bittor/torfile"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"math/rand/v2"
+	"net"
+)
+
+// DefaultPieceLength keeps test payloads to a handful of blocks per piece
+const DefaultPieceLength = 64 << 10
+
+// Swarm is a single file torrent with a tracker and its seeders
+type Swarm struct {
+	Tracker *Tracker
+	Seeders []*Seeder
+	// the torrent's metainfo and the payload the seeders serve
+	Metainfo []byte
+	File     torfile.File
+	Data     []byte
+}
+
+// Data returns n bytes of reproducible pseudo random payload
+func Data(n int, seed uint64) []byte {
+	r := rand.New(rand.NewPCG(seed, seed))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	return data
+}
+
+type metainfo struct {
+	Announce string   `bencode:"announce"`
+	Info     infoDict `bencode:"info"`
+}
+
+type infoDict struct {
+	Length      int        `bencode:"length,omitempty"`
+	Files       []fileDict `bencode:"files,omitempty"`
+	Name        string     `bencode:"name"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+}
+
+type fileDict struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// New starts a tracker and one seeder per config serving data. pieceLength
+// is DefaultPieceLength when 0
+func New(data []byte, pieceLength int, seeders ...SeederConfig) (*Swarm, error) {
+	return newSwarm(infoDict{Length: len(data), Name: "swarmtest.bin"}, data, pieceLength, seeders)
+}
+
+// NewFiles is New for a multi file torrent, data is split into files of
+// the given lengths named file0.bin, file1.bin and so on in directory
+// swarmtest. The lengths must add up to len(data)
+func NewFiles(data []byte, lengths []int, pieceLength int, seeders ...SeederConfig) (*Swarm, error) {
+	info := infoDict{Name: "swarmtest"}
+	total := 0
+	for i, n := range lengths {
+		info.Files = append(info.Files, fileDict{Length: n, Path: []string{fmt.Sprintf("file%d.bin", i)}})
+		total += n
+	}
+	if total != len(data) {
+		return nil, fmt.Errorf("file lengths add up to %d, data is %d bytes", total, len(data))
+	}
+	return newSwarm(info, data, pieceLength, seeders)
+}
+
+func newSwarm(info infoDict, data []byte, pieceLength int, seeders []SeederConfig) (*Swarm, error) {
+	if pieceLength <= 0 {
+		pieceLength = DefaultPieceLength
+	}
+	tr := NewTracker()
+	s := &Swarm{Tracker: tr, Data: data}
+
+	info.PieceLength = pieceLength
+	for off := 0; off < len(data); off += pieceLength {
+		sum := sha1.Sum(data[off:min(off+pieceLength, len(data))])
+		info.Pieces = append(info.Pieces, sum[:]...)
+	}
+	var err error
+	if s.Metainfo, err = bencode.Marshal(metainfo{Announce: tr.URL, Info: info}); err != nil {
+		tr.Close()
+		return nil, err
+	}
+	if s.File, err = torfile.Parse(s.Metainfo); err != nil {
+		tr.Close()
+		return nil, err
+	}
+
+	for i, cfg := range seeders {
+		ip := net.IPv4(127, 0, 0, byte(2+i%250))
+		sd, err := newSeeder(ip, cfg, s.File.InfoHash, data, pieceLength)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("seeder %d: %w", i, err)
+		}
+		s.Seeders = append(s.Seeders, sd)
+		tr.AddPeers(s.File.InfoHash, sd.Peer)
+	}
+	return s, nil
+}
+
+// Torrent announces to the tracker and returns a torrent ready to download
+// from the seeders
+func (s *Swarm) Torrent(ctx context.Context) (*p2p.Torrent, error) {
+	return s.File.NewTorrent(ctx, peer.NewID(), 6881)
+}
+
+// Seeder returns the seeder listening as p, nil when there is none
+func (s *Swarm) Seeder(p peer.Peer) *Seeder {
+	for _, sd := range s.Seeders {
+		if sd.Peer.IP.Equal(p.IP) && sd.Peer.Port == p.Port {
+			return sd
+		}
+	}
+	return nil
+}
+
+func (s *Swarm) Close() {
+	for _, sd := range s.Seeders {
+		sd.Close()
+	}
+	s.Tracker.Close()
+}
@@ -0,0 +1,103 @@
+package swarmtest
+
+import (
+	"bittor/bencode"
+	"bittor/peer"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// Announce is a request the tracker received
+type Announce struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Event      string
+	Downloaded int
+}
+
+// Tracker is an HTTP tracker stand-in that hands out a fixed peer list
+type Tracker struct {
+	// announce url for metainfo
+	URL string
+
+	// when set every announce fails with it
+	FailureReason string
+
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	peers     map[[20]byte][]peer.Peer
+	announces []Announce
+}
+
+func NewTracker() *Tracker {
+	t := &Tracker{peers: map[[20]byte][]peer.Peer{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /announce", t.announce)
+	t.srv = httptest.NewServer(mux)
+	t.URL = t.srv.URL + "/announce"
+	return t
+}
+
+func (t *Tracker) Close() {
+	t.srv.Close()
+}
+
+// AddPeers registers peers handed out for infoHash
+func (t *Tracker) AddPeers(infoHash [20]byte, peers ...peer.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers[infoHash] = append(t.peers[infoHash], peers...)
+}
+
+// Announces returns the announces received so far in order
+func (t *Tracker) Announces() []Announce {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Announce(nil), t.announces...)
+}
+
+type announceResp struct {
+	FailureReason string `bencode:"failure reason,omitempty"`
+	Interval      int    `bencode:"interval,omitempty"`
+	Peers         []byte `bencode:"peers,omitempty"`
+}
+
+func (t *Tracker) announce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var a Announce
+	copy(a.InfoHash[:], q.Get("info_hash"))
+	copy(a.PeerID[:], q.Get("peer_id"))
+	port, _ := strconv.Atoi(q.Get("port"))
+	a.Port = uint16(port)
+	a.Event = q.Get("event")
+	a.Downloaded, _ = strconv.Atoi(q.Get("downloaded"))
+
+	t.mu.Lock()
+	t.announces = append(t.announces, a)
+	peers := t.peers[a.InfoHash]
+	failure := t.FailureReason
+	t.mu.Unlock()
+
+	resp := announceResp{FailureReason: failure}
+	if failure == "" {
+		resp.Interval = 1800
+		// compact form (BEP 23)
+		for _, p := range peers {
+			entry := make([]byte, peer.PeerBinSize)
+			copy(entry, p.IP.To4())
+			binary.BigEndian.PutUint16(entry[4:], p.Port)
+			resp.Peers = append(resp.Peers, entry...)
+		}
+	}
+	body, err := bencode.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(body)
+}
@@ -1,27 +1,29 @@
 package torfile
 
 import (
-	"bytes"
+	"bittor/bencode"
 	"crypto/sha1"
+	"errors"
 	"fmt"
-
-	"github.com/jackpal/bencode-go"
+	"path"
+	"strings"
 )
 
 type bencodeInfo struct {
 	Pieces      string `bencode:"pieces"`
 	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	// single file torrents only
+	Length int    `bencode:"length,omitempty"`
+	Name   string `bencode:"name"`
+	// multi file torrents only
+	Files []bencodeFile `bencode:"files,omitempty"`
+	// 1 restricts peers to those handed out by the tracker (BEP 27)
+	Private int `bencode:"private,omitempty"`
 }
 
-// marshalls info to byte array and hashes with sha1
-func (bi *bencodeInfo) hash() ([20]byte, error) {
-	var bs bytes.Buffer
-	if err := bencode.Marshal(&bs, *bi); err != nil {
-		return [20]byte{}, err
-	}
-	return sha1.Sum(bs.Bytes()), nil
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 func (bi *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -44,25 +46,67 @@ func (bi *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list"`
+	// kept as encoded, the info hash is taken over these exact bytes.
+	// Re-encoding a decoded struct drops keys it doesn't know about
+	Info bencode.RawMessage `bencode:"info"`
+}
+
+// file list in payload order, single file torrents get one entry
+func (bi *bencodeInfo) fileEntries() ([]FileEntry, int, error) {
+	if len(bi.Files) == 0 {
+		return []FileEntry{{Path: bi.Name, Length: bi.Length}}, bi.Length, nil
+	}
+
+	entries := make([]FileEntry, len(bi.Files))
+	offset := 0
+	for i, f := range bi.Files {
+		if len(f.Path) == 0 || f.Length < 0 {
+			return nil, 0, fmt.Errorf("invalid file entry %d in info", i)
+		}
+		for _, elem := range f.Path {
+			if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, "/\\") {
+				return nil, 0, fmt.Errorf("unsafe path element %q in file entry %d", elem, i)
+			}
+		}
+		entries[i] = FileEntry{
+			Path:   path.Join(append([]string{bi.Name}, f.Path...)...),
+			Length: f.Length,
+			Offset: offset,
+		}
+		offset += f.Length
+	}
+	return entries, offset, nil
 }
 
 func (bt bencodeTorrent) toFile() (File, error) {
-	hash, err := bt.Info.hash()
+	if len(bt.Info) == 0 || bt.Info[0] != 'd' {
+		return File{}, errors.New("torrent has no info dictionary")
+	}
+	var info bencodeInfo
+	if err := bencode.Unmarshal(bt.Info, &info); err != nil {
+		return File{}, fmt.Errorf("torrent info: %w", err)
+	}
+
+	pieces, err := info.splitPieceHashes()
 	if err != nil {
 		return File{}, err
 	}
-	pieces, err := bt.Info.splitPieceHashes()
+	files, length, err := info.fileEntries()
 	if err != nil {
 		return File{}, err
 	}
 	return File{
-		Announce:    bt.Announce,
-		Name:        bt.Info.Name,
-		InfoHash:    hash,
-		PieceHashes: pieces,
-		PieceLength: bt.Info.PieceLength,
-		Length:      bt.Info.Length,
+		Announce:     bt.Announce,
+		AnnounceList: bt.AnnounceList,
+		Name:         info.Name,
+		InfoHash:     sha1.Sum(bt.Info),
+		InfoBytes:    bt.Info,
+		Private:      info.Private == 1,
+		PieceHashes:  pieces,
+		PieceLength:  info.PieceLength,
+		Length:       length,
+		Files:        files,
 	}, nil
 }
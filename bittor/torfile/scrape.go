@@ -0,0 +1,181 @@
+package torfile
+
+import (
+	"bittor/bencode"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// ScrapeResult is the swarm health a tracker reports for one info hash
+type ScrapeResult struct {
+	Tracker   string
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+// Scrape asks every tracker of the torrent for swarm counts. Results and
+// errors are indexed like Trackers
+func (f *File) Scrape(ctx context.Context) ([]ScrapeResult, []error) {
+	trackers := f.Trackers()
+	results, errs := make([]ScrapeResult, len(trackers)), make([]error, len(trackers))
+
+	done := make(chan struct{})
+	for i, tracker := range trackers {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			results[i], errs[i] = Scrape(ctx, tracker, f.InfoHash)
+		}()
+	}
+	for range trackers {
+		<-done
+	}
+	return results, errs
+}
+
+// Scrape queries a single http(s) or udp tracker for infoHash
+func Scrape(ctx context.Context, tracker string, infoHash [20]byte) (ScrapeResult, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, u, infoHash)
+	case "udp":
+		return scrapeUDP(ctx, u, infoHash)
+	default:
+		return ScrapeResult{}, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// scrape url is derived by replacing `announce` in the last path element
+// with `scrape`, trackers without it can't be scraped
+// https://www.bittorrent.org/beps/bep_0048.html
+func scrapeURL(announce *url.URL) (*url.URL, error) {
+	idx := strings.LastIndex(announce.Path, "/")
+	if idx < 0 || !strings.HasPrefix(announce.Path[idx+1:], "announce") {
+		return nil, ErrScrapeUnsupported
+	}
+	u := *announce
+	u.Path = announce.Path[:idx+1] + "scrape" + strings.TrimPrefix(announce.Path[idx+1:], "announce")
+	return &u, nil
+}
+
+func scrapeHTTP(ctx context.Context, announce *url.URL, infoHash [20]byte) (ScrapeResult, error) {
+	u, err := scrapeURL(announce)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	// keep passkeys or other query params of the announce url
+	q := u.Query()
+	q.Set("info_hash", string(infoHash[:]))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Do(req)
+	if err != nil {
+		return ScrapeResult{}, trackerRequestError(u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ScrapeResult{}, trackerRequestError(u, errors.New(resp.Status))
+	}
+
+	res, failure, found, err := parseScrape(resp.Body, infoHash)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	if failure != "" {
+		return ScrapeResult{}, &TrackerError{Tracker: redactURL(u), Reason: failure}
+	}
+	if !found {
+		return ScrapeResult{}, fmt.Errorf("tracker has no stats for %x", infoHash)
+	}
+	res.Tracker = redactURL(announce)
+	return res, nil
+}
+
+// walks a scrape response picking out the stats for infoHash, other
+// torrents in the files dictionary are skipped without being decoded
+func parseScrape(r io.Reader, infoHash [20]byte) (res ScrapeResult, failure string, found bool, err error) {
+	tok := bencode.NewTokenizer(r)
+	first, err := tok.Next()
+	if err != nil {
+		return res, "", false, err
+	}
+	if first.Kind != bencode.TokenDict {
+		return res, "", false, errors.New("scrape response is not a dictionary")
+	}
+
+	err = tok.Dict(func(key string) error {
+		switch key {
+		case "failure reason":
+			v, err := tok.Next()
+			if err != nil {
+				return err
+			}
+			failure = string(v.Bytes)
+			return tok.Skip(v)
+		case "files":
+			files, err := tok.Next()
+			if err != nil {
+				return err
+			}
+			if files.Kind != bencode.TokenDict {
+				return tok.Skip(files)
+			}
+			return tok.Dict(func(hash string) error {
+				if hash != string(infoHash[:]) {
+					return tok.SkipValue()
+				}
+				found = true
+				return parseScrapeStats(tok, &res)
+			})
+		default:
+			return tok.SkipValue()
+		}
+	})
+	return res, failure, found, err
+}
+
+func parseScrapeStats(tok *bencode.Tokenizer, res *ScrapeResult) error {
+	stats, err := tok.Next()
+	if err != nil {
+		return err
+	}
+	if stats.Kind != bencode.TokenDict {
+		return tok.Skip(stats)
+	}
+	return tok.Dict(func(key string) error {
+		v, err := tok.Next()
+		if err != nil {
+			return err
+		}
+		if v.Kind != bencode.TokenInt {
+			return tok.Skip(v)
+		}
+		switch key {
+		case "complete":
+			res.Seeders = int(v.Int)
+		case "incomplete":
+			res.Leechers = int(v.Int)
+		case "downloaded":
+			res.Completed = int(v.Int)
+		}
+		return nil
+	})
+}
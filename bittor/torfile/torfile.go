@@ -1,53 +1,102 @@
 package torfile
 
 import (
+	"bittor/bencode"
 	"bittor/p2p"
-	"crypto/rand"
+	"bittor/peer"
+	"bittor/portmap"
+	"bittor/storage"
+	"context"
+	"fmt"
+	"log"
 	"os"
-
-	"github.com/jackpal/bencode-go"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-// Port to listen on
-const Port uint16 = 6881
-
 type File struct {
-	Announce    string
-	InfoHash    [20]byte
+	Announce string
+	// tiers of tracker urls (BEP 12), may be empty
+	AnnounceList [][]string
+	InfoHash     [20]byte
+	// info dictionary exactly as encoded in the .torrent, InfoHash is its sha1
+	InfoBytes   []byte
 	PieceHashes [][20]byte
 	PieceLength int
-	Length      int
-	Name        string
+	// total payload length over all files
+	Length int
+	Name   string
+	Files  []FileEntry
+	// private torrents only use peers from their trackers, no DHT, PEX or LSD
+	Private bool
+
+	// called after every announce, successful or not, e.g. to show the
+	// tracker's state
+	OnAnnounce func(AnnounceResult)
+}
+
+// FileEntry is a file of the torrent payload
+type FileEntry struct {
+	// slash separated, starts with the torrent name for multi file torrents
+	Path   string
+	Length int
+	// byte offset of the file within the payload
+	Offset int
+}
+
+// Trackers returns every tracker url, announce-list tiers first
+func (f *File) Trackers() []string {
+	var urls []string
+	seen := map[string]bool{}
+	add := func(u string) {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	for _, tier := range f.AnnounceList {
+		for _, u := range tier {
+			add(u)
+		}
+	}
+	add(f.Announce)
+	return urls
 }
 
 func Read(path string) (File, error) {
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return File{}, err
 	}
-	defer file.Close()
+	return Parse(data)
+}
 
+// Parse decodes the contents of a .torrent file
+func Parse(data []byte) (File, error) {
 	bt := bencodeTorrent{}
-	if err := bencode.Unmarshal(file, &bt); err != nil {
+	if err := bencode.Unmarshal(data, &bt); err != nil {
 		return File{}, err
 	}
-
 	return bt.toFile()
 }
 
-func (f *File) Download(path string) error {
-	var peerID [20]byte
-	// This never returns error
-	rand.Read(peerID[:])
-
-	//? PORT NEEDS TO BE DYNAMIC
-	peers, err := f.requestPeers(peerID, Port)
+// NewTorrent announces to the tracker and returns a torrent ready to download
+// from the returned peers
+func (f *File) NewTorrent(ctx context.Context, peerID [20]byte, port uint16) (*p2p.Torrent, error) {
+	peers, err := f.AnnounceEvent(ctx, peerID, port, EventStarted, 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	tor := p2p.Torrent{
-		Peers:       peers,
+	tor := f.Torrent(peerID)
+	tor.Peers = peers
+	return tor, nil
+}
+
+// Torrent returns a torrent for f without announcing, e.g. for seeding
+func (f *File) Torrent(peerID [20]byte) *p2p.Torrent {
+	return &p2p.Torrent{
 		PeerID:      peerID,
 		InfoHash:    f.InfoHash,
 		PieceHashes: f.PieceHashes,
@@ -55,19 +104,143 @@ func (f *File) Download(path string) error {
 		Length:      f.Length,
 		Name:        f.Name,
 	}
-	buf, err := tor.Download()
+}
+
+// Download fetches the torrent into path. Pieces are written as they are
+// verified so cancelling ctx leaves the completed ones on disk
+func (f *File) Download(ctx context.Context, path string) error {
+	ln, err := portmap.Listen(0)
 	if err != nil {
 		return err
 	}
+	defer ln.Close()
+	port := portmap.ListenPort(ln)
 
-	outFile, err := os.Create(path)
+	tor, err := f.NewTorrent(ctx, peer.NewID(), port)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
+	go tor.Serve(ctx, ln)
+
+	return f.DownloadTo(ctx, tor, path, port)
+}
+
+// Layout is how the payload splits into pieces, for opening a storage.Storage
+func (f *File) Layout() storage.Layout {
+	return storage.Layout{PieceLength: f.PieceLength, Length: f.Length}
+}
 
-	if _, err := outFile.Write(buf); err != nil {
+// Spans returns where each payload file lives under path: path itself for
+// single file torrents, below the directory path for multi file torrents
+func (f *File) Spans(path string) []storage.FileSpan {
+	spans := make([]storage.FileSpan, len(f.Files))
+	for i, fe := range f.Files {
+		spans[i] = storage.FileSpan{Path: path, Length: int64(fe.Length)}
+		if len(f.Files) == 1 && fe.Path == f.Name {
+			continue
+		}
+		rel := strings.TrimPrefix(fe.Path, f.Name+"/")
+		spans[i].Path = filepath.Join(path, filepath.FromSlash(rel))
+	}
+	return spans
+}
+
+// DownloadTo runs tor writing into path, then flushes the data and tells the
+// tracker whether the download completed or stopped. Unless tor.Storage was
+// set by the caller path is written through a write cache
+func (f *File) DownloadTo(ctx context.Context, tor *p2p.Torrent, path string, port uint16) error {
+	if tor.Storage == nil {
+		st, err := storage.OpenFiles(f.Spans(path), f.Layout())
+		if err != nil {
+			return err
+		}
+		cache := storage.NewCache(st, f.Layout(), 0)
+		tor.Storage = cache
+		// a paused session torrent calls this again later
+		defer func() {
+			cache.Close()
+			tor.Storage = nil
+		}()
+	}
+
+	rctx, stopAnnounce := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.reannounce(rctx, tor, port)
+	}()
+	_, dlErr := tor.Download(ctx)
+	stopAnnounce()
+	<-done
+	// flush whatever was verified, even when stopped part way
+	if err := tor.Storage.Sync(); err != nil && dlErr == nil {
+		dlErr = err
+	}
+
+	event := EventCompleted
+	if dlErr != nil {
+		event = EventStopped
+	}
+	// ctx is likely cancelled already, the tracker still needs to hear about it
+	actx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if _, err := f.AnnounceEvent(actx, tor.PeerID, port, event, tor.Stats().Downloaded); err != nil {
+		log.Printf("announcing %s to tracker failed: %v", event, err)
+	}
+
+	return dlErr
+}
+
+// announces at the interval the tracker asks for until ctx is done, handing
+// new peers to tor. Failed announces are retried at the same pace
+func (f *File) reannounce(ctx context.Context, tor *p2p.Torrent, port uint16) {
+	interval := defaultAnnounceInterval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		res := f.announce(ctx, tor.PeerID, port, EventNone, tor.Stats().Downloaded)
+		if res.Err != nil {
+			if ctx.Err() == nil {
+				log.Printf("re-announcing to tracker failed: %v", res.Err)
+			}
+			continue
+		}
+		if res.Interval > 0 {
+			interval = max(res.Interval, minAnnounceInterval)
+		}
+		tor.AddPeers(res.Peers)
+	}
+}
+
+// Seed uploads the complete data at path with tor until ctx is done. Every
+// piece must be marked verified, e.g. with verify.Resume
+func (f *File) Seed(ctx context.Context, tor *p2p.Torrent, path string, port uint16) error {
+	if st := tor.Stats(); !st.Complete {
+		return fmt.Errorf("%s has %d/%d pieces, only complete data can be seeded", path, st.Done, st.Pieces)
+	}
+	if tor.Storage == nil {
+		// only read, existing data is never created or resized
+		st := storage.ReadFiles(f.Spans(path), f.Layout())
+		tor.Storage = st
+		defer func() {
+			st.Close()
+			tor.Storage = nil
+		}()
+	}
+
+	// left is derived from downloaded, a seed has nothing left
+	if _, err := f.AnnounceEvent(ctx, tor.PeerID, port, EventStarted, f.Length); err != nil {
 		return err
 	}
-	return nil
+	err := tor.Seed(ctx)
+
+	actx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if _, err := f.AnnounceEvent(actx, tor.PeerID, port, EventStopped, f.Length); err != nil {
+		log.Printf("announcing %s to tracker failed: %v", EventStopped, err)
+	}
+	return err
 }
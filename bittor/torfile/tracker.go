@@ -1,18 +1,97 @@
 package torfile
 
 import (
+	"bittor/bencode"
 	"bittor/peer"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
+)
+
+// tracker announce events
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
 
-	"github.com/jackpal/bencode-go"
+const (
+	// re-announce interval until the tracker told us its own
+	defaultAnnounceInterval = 30 * time.Minute
+	// shorter intervals from trackers are raised to this
+	minAnnounceInterval = time.Minute
 )
 
-type bencodeTrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+// AnnounceResult is the outcome of one announce, passed to File.OnAnnounce
+type AnnounceResult struct {
+	// announce url with passkeys redacted
+	Tracker string
+	Event   string
+	Time    time.Time
+	Peers   []peer.Peer
+	// time the tracker wants between announces, 0 when it didn't say
+	Interval time.Duration
+	Err      error
+}
+
+type trackerResp struct {
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Interval       int    `bencode:"interval"`
+	// compact string (BEP 23) or the original list of dictionaries
+	Peers bencode.RawMessage `bencode:"peers"`
+}
+
+type trackerPeer struct {
+	IP   string `bencode:"ip"`
+	Port int    `bencode:"port"`
+}
+
+// TrackerError is a failure reported by the tracker itself, e.g. an
+// unregistered torrent or an invalid passkey
+type TrackerError struct {
+	// announce url with passkeys redacted
+	Tracker string
+	Reason  string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker %s: %s", e.Tracker, e.Reason)
+}
+
+// path elements at least this long are assumed to be passkeys
+const passkeyMinLen = 16
+
+// strips the query and passkey looking path elements so tracker urls can be
+// logged and returned in errors without leaking credentials
+func redactURL(u *url.URL) string {
+	parts := strings.Split(u.Path, "/")
+	for i, p := range parts {
+		if len(p) >= passkeyMinLen {
+			parts[i] = "REDACTED"
+		}
+	}
+	r := url.URL{Scheme: u.Scheme, Host: u.Host, Path: strings.Join(parts, "/")}
+	return r.String()
+}
+
+// replaces the url in http client errors, they embed the full request url
+// including passkey and info hash
+func trackerRequestError(u *url.URL, err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		err = uerr.Err
+	}
+	return fmt.Errorf("tracker %s: %w", redactURL(u), err)
 }
 
 /*
@@ -21,7 +100,7 @@ We’ll just generate 20 random bytes for this.
 Real BitTorrent clients have IDs like -TR2940-k8hj0wgej6ch which identify the client software and version—in this case,
 TR2940 stands for Transmission client 2.94.
 */
-func (f *File) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
+func (f *File) buildTrackerURL(peerID [20]byte, port uint16, event string, downloaded int) (string, error) {
 	base, err := url.Parse(f.Announce)
 	if err != nil {
 		return "", err
@@ -31,32 +110,114 @@ func (f *File) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
 		"peer_id":    []string{string(peerID[:])},
 		"port":       []string{strconv.Itoa(int(port))},
 		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"downloaded": []string{strconv.Itoa(downloaded)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(f.Length)},
+		"left":       []string{strconv.Itoa(f.Length - downloaded)},
+	}
+	if event != EventNone {
+		params.Set("event", event)
 	}
 
-	base.RawQuery = params.Encode()
+	// passkey style announce urls carry their own query, keep it as is
+	if base.RawQuery != "" {
+		base.RawQuery += "&" + params.Encode()
+	} else {
+		base.RawQuery = params.Encode()
+	}
 	return base.String(), nil
 }
 
-func (f *File) requestPeers(peerID [20]byte, port uint16) ([]peer.Peer, error) {
-	url, err := f.buildTrackerURL(peerID, port)
+// AnnounceEvent reports our state to the tracker and returns the peers it
+// handed out. f.OnAnnounce hears about the outcome either way
+func (f *File) AnnounceEvent(ctx context.Context, peerID [20]byte, port uint16, event string, downloaded int) ([]peer.Peer, error) {
+	res := f.announce(ctx, peerID, port, event, downloaded)
+	return res.Peers, res.Err
+}
+
+// announces and passes the outcome to f.OnAnnounce
+func (f *File) announce(ctx context.Context, peerID [20]byte, port uint16, event string, downloaded int) AnnounceResult {
+	res := AnnounceResult{Event: event, Time: time.Now()}
+	if u, err := url.Parse(f.Announce); err == nil {
+		res.Tracker = redactURL(u)
+	}
+	res.Peers, res.Interval, res.Err = f.request(ctx, peerID, port, event, downloaded)
+	if f.OnAnnounce != nil {
+		f.OnAnnounce(res)
+	}
+	return res
+}
+
+func (f *File) request(ctx context.Context, peerID [20]byte, port uint16, event string, downloaded int) ([]peer.Peer, time.Duration, error) {
+	rawURL, err := f.buildTrackerURL(peerID, port, event, downloaded)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, 0, err
 	}
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
 	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
+	resp, err := c.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, trackerRequestError(u, err)
 	}
 	defer resp.Body.Close()
 
-	var btResp bencodeTrackerResp
-	if err := bencode.Unmarshal(resp.Body, &btResp); err != nil {
-		return nil, err
+	// trackers report failures in a bencoded body, sometimes with an error status
+	btResp, err := parseAnnounce(resp.Body)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, 0, trackerRequestError(u, errors.New(resp.Status))
+		}
+		return nil, 0, trackerRequestError(u, err)
+	}
+	if btResp.FailureReason != "" {
+		return nil, 0, &TrackerError{Tracker: redactURL(u), Reason: btResp.FailureReason}
 	}
+	if btResp.WarningMessage != "" {
+		log.Printf("tracker %s warning: %s", redactURL(u), btResp.WarningMessage)
+	}
+
+	peers, err := parsePeers(btResp.Peers)
+	return peers, time.Duration(btResp.Interval) * time.Second, err
+}
 
-	return peer.Unmarshal([]byte(btResp.Peers))
+func parseAnnounce(r io.Reader) (trackerResp, error) {
+	var res trackerResp
+	err := bencode.NewDecoder(r).Decode(&res)
+	return res, err
+}
+
+// decodes the peers of an announce response, hostnames and malformed
+// entries of the dictionary form are dropped
+func parsePeers(raw bencode.RawMessage) ([]peer.Peer, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if raw[0] != 'l' {
+		var compact []byte
+		if err := bencode.Unmarshal(raw, &compact); err != nil {
+			return nil, err
+		}
+		return peer.Unmarshal(compact)
+	}
+
+	var list []trackerPeer
+	if err := bencode.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	peers := make([]peer.Peer, 0, len(list))
+	for _, tp := range list {
+		ip := net.ParseIP(tp.IP)
+		if ip == nil || tp.Port <= 0 || tp.Port > 65535 {
+			continue
+		}
+		peers = append(peers, peer.Peer{IP: ip, Port: uint16(tp.Port)})
+	}
+	return peers, nil
 }
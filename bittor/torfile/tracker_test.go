@@ -0,0 +1,56 @@
+package torfile_test
+
+import (
+	"bittor/peer"
+	"bittor/swarmtest"
+	"bittor/torfile"
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// OnAnnounce hears about every announce, failed ones included
+func TestOnAnnounce(t *testing.T) {
+	s, err := swarmtest.New(swarmtest.Data(64<<10, 1), swarmtest.DefaultPieceLength, swarmtest.SeederConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	u, err := url.Parse(s.Tracker.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []torfile.AnnounceResult
+	tf := s.File
+	tf.OnAnnounce = func(res torfile.AnnounceResult) { got = append(got, res) }
+
+	peers, err := tf.AnnounceEvent(context.Background(), peer.NewID(), 6881, torfile.EventStarted, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Tracker.FailureReason = "unregistered torrent"
+	if _, err := tf.AnnounceEvent(context.Background(), peer.NewID(), 6881, torfile.EventStopped, 0); err == nil {
+		t.Fatal("announce to a failing tracker succeeded")
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("OnAnnounce called %d times, want 2", len(got))
+	}
+	ok, failed := got[0], got[1]
+	if ok.Err != nil || ok.Event != torfile.EventStarted || len(ok.Peers) != len(peers) || len(peers) != 1 ||
+		ok.Interval != 30*time.Minute || ok.Time.IsZero() {
+		t.Fatalf("successful announce reported as %+v", ok)
+	}
+	var terr *torfile.TrackerError
+	if !errors.As(failed.Err, &terr) || terr.Reason != "unregistered torrent" || failed.Event != torfile.EventStopped || len(failed.Peers) != 0 {
+		t.Fatalf("failed announce reported as %+v", failed)
+	}
+	for _, res := range got {
+		if tu, err := url.Parse(res.Tracker); err != nil || tu.Host != u.Host {
+			t.Fatalf("announce to %s reported for %s", res.Tracker, u.Host)
+		}
+	}
+}
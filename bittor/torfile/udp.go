@@ -0,0 +1,134 @@
+package torfile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// https://www.bittorrent.org/beps/bep_0015.html
+const (
+	udpProtocolID uint64 = 0x41727101980
+
+	udpActionConnect uint32 = 0
+	udpActionScrape  uint32 = 2
+	udpActionError   uint32 = 3
+
+	// attempts per request and how long to wait for each
+	udpAttempts = 3
+	udpTimeout  = 5 * time.Second
+)
+
+// udp tracker session holding the connection id from the connect exchange
+type udpTracker struct {
+	conn   net.Conn
+	connID uint64
+	// redacted url for errors
+	tracker string
+}
+
+func dialUDPTracker(ctx context.Context, u *url.URL) (*udpTracker, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	t := &udpTracker{conn: conn, tracker: redactURL(u)}
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	resp, err := t.roundTrip(ctx, req, 16)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.connID = binary.BigEndian.Uint64(resp[8:16])
+	return t, nil
+}
+
+func (t *udpTracker) Close() error {
+	return t.conn.Close()
+}
+
+// sends req with a fresh transaction id at bytes 12:16 and returns a response
+// of at least minLen bytes for the same transaction, retrying on timeout
+func (t *udpTracker) roundTrip(ctx context.Context, req []byte, minLen int) ([]byte, error) {
+	action := binary.BigEndian.Uint32(req[8:12])
+	var tid [4]byte
+	// This never returns error
+	rand.Read(tid[:])
+	copy(req[12:16], tid[:])
+
+	stop := context.AfterFunc(ctx, func() { t.conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, 2048)
+	for range udpAttempts {
+		if _, err := t.conn.Write(req); err != nil {
+			return nil, err
+		}
+		t.conn.SetReadDeadline(time.Now().Add(udpTimeout))
+
+		for {
+			n, err := t.conn.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			resp := buf[:n]
+			// stale answer to an earlier attempt or junk
+			if n < 8 || [4]byte(resp[4:8]) != tid {
+				continue
+			}
+			switch got := binary.BigEndian.Uint32(resp[:4]); got {
+			case udpActionError:
+				return nil, &TrackerError{Tracker: t.tracker, Reason: string(resp[8:])}
+			case action:
+				if n < minLen {
+					return nil, fmt.Errorf("udp tracker response too short. %d < %d", n, minLen)
+				}
+				return append([]byte(nil), resp...), nil
+			default:
+				return nil, fmt.Errorf("expected udp action %d but got %d", action, got)
+			}
+		}
+	}
+	return nil, errors.New("udp tracker did not respond")
+}
+
+func scrapeUDP(ctx context.Context, u *url.URL, infoHash [20]byte) (ScrapeResult, error) {
+	t, err := dialUDPTracker(ctx, u)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	defer t.Close()
+
+	// connection id + action + transaction id + info hash
+	req := make([]byte, 36)
+	binary.BigEndian.PutUint64(req[:8], t.connID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+	copy(req[16:], infoHash[:])
+
+	// action + transaction id + seeders + completed + leechers
+	resp, err := t.roundTrip(ctx, req, 20)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	return ScrapeResult{
+		Tracker:   redactURL(u),
+		Seeders:   int(binary.BigEndian.Uint32(resp[8:12])),
+		Completed: int(binary.BigEndian.Uint32(resp[12:16])),
+		Leechers:  int(binary.BigEndian.Uint32(resp[16:20])),
+	}, nil
+}
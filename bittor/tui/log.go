@@ -0,0 +1,49 @@
+package tui
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// LogBuffer keeps the last lines written to it, e.g. as the log output
+// while the view owns the terminal
+type LogBuffer struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func NewLogBuffer(max int) *LogBuffer {
+	return &LogBuffer{max: max}
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.partial = append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.lines = append(b.lines, strings.TrimRight(string(b.partial[:i]), "\r"))
+		b.partial = b.partial[i+1:]
+	}
+	if over := len(b.lines) - b.max; over > 0 {
+		b.lines = append(b.lines[:0], b.lines[over:]...)
+	}
+	return len(p), nil
+}
+
+// Lines returns up to n of the most recent complete lines, oldest first
+func (b *LogBuffer) Lines(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > len(b.lines) {
+		n = len(b.lines)
+	}
+	return append([]string(nil), b.lines[len(b.lines)-n:]...)
+}
@@ -0,0 +1,16 @@
+//go:build !(linux || darwin)
+
+package tui
+
+import (
+	"errors"
+	"os"
+)
+
+func termSize(f *os.File) (width, height int, ok bool) {
+	return 0, 0, false
+}
+
+func keyMode(f *os.File) (func(), error) {
+	return nil, errors.New("key input is not supported on this platform")
+}
@@ -0,0 +1,323 @@
+// Package tui draws a live view of a download on an ANSI terminal: overall
+// progress, a piece map, connected peers and the tracker, all read from the
+// torrent's own state
+package tui
+
+import (
+	"bittor/p2p"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the view redraws
+	DefaultInterval = 500 * time.Millisecond
+	// log lines shown below the peers
+	logLines = 3
+	// most rows the piece map takes
+	maxMapRows = 8
+)
+
+// ANSI escapes
+const (
+	home      = "\x1b[H"
+	clearEOL  = "\x1b[K"
+	clearDown = "\x1b[J"
+	clearAll  = "\x1b[2J"
+	hideCur   = "\x1b[?25l"
+	showCur   = "\x1b[?25h"
+	bold      = "\x1b[1m"
+	dim       = "\x1b[2m"
+	green     = "\x1b[32m"
+	yellow    = "\x1b[33m"
+	red       = "\x1b[31m"
+	reset     = "\x1b[0m"
+)
+
+// Tracker is what the caller learned from its last announce
+type Tracker struct {
+	Host      string
+	Announced time.Time
+	Peers     int
+	Err       error
+}
+
+// peer list orders, cycled with the s key
+const (
+	sortDown = iota
+	sortUp
+	sortAddr
+	numSorts
+)
+
+var sortNames = [numSorts]string{"download", "upload", "address"}
+
+// View draws a torrent's progress until its context is done
+type View struct {
+	Torrent *p2p.Torrent
+	// optional, recent lines are shown at the bottom
+	Log *LogBuffer
+
+	out *os.File
+	in  *os.File
+
+	mu      sync.Mutex
+	tracker Tracker
+	sort    int
+}
+
+// New returns a view drawing to out. Keys are read from in when it is a
+// terminal, nil disables them
+func New(tor *p2p.Torrent, out, in *os.File) *View {
+	return &View{Torrent: tor, out: out, in: in}
+}
+
+func (v *View) SetTracker(tr Tracker) {
+	v.mu.Lock()
+	v.tracker = tr
+	v.mu.Unlock()
+}
+
+// Run redraws every interval until ctx is done and leaves the last frame on
+// screen. Pressing q calls quit, s changes the peer order
+func (v *View) Run(ctx context.Context, interval time.Duration, quit func()) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	if v.in != nil {
+		if restore, err := keyMode(v.in); err == nil {
+			defer restore()
+			go v.readKeys(ctx, quit)
+		}
+	}
+
+	io.WriteString(v.out, clearAll+hideCur)
+	defer io.WriteString(v.out, showCur)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		v.draw()
+		select {
+		case <-ctx.Done():
+			v.draw()
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// the goroutine stays blocked on the terminal after Run returned, it only
+// acts while ctx is live
+func (v *View) readKeys(ctx context.Context, quit func()) {
+	buf := make([]byte, 1)
+	for {
+		if _, err := v.in.Read(buf); err != nil || ctx.Err() != nil {
+			return
+		}
+		switch buf[0] {
+		case 'q', 'Q':
+			if quit != nil {
+				quit()
+			}
+		case 's', 'S':
+			v.mu.Lock()
+			v.sort = (v.sort + 1) % numSorts
+			v.mu.Unlock()
+		}
+	}
+}
+
+func (v *View) draw() {
+	width, height, ok := termSize(v.out)
+	if !ok {
+		width, height = 100, 30
+	}
+	lines := v.frame(width, height)
+
+	var b strings.Builder
+	b.WriteString(home)
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteString(reset + clearEOL + "\r\n")
+	}
+	b.WriteString(clearDown)
+	io.WriteString(v.out, b.String())
+}
+
+// builds the screen lines for a width x height terminal
+func (v *View) frame(width, height int) []string {
+	v.mu.Lock()
+	tracker, order := v.tracker, v.sort
+	v.mu.Unlock()
+	st := v.Torrent.Stats()
+	pieces := v.Torrent.Pieces()
+	peers := v.Torrent.PeerStats()
+	// the last line stays free, writing it would scroll the screen
+	height--
+
+	var lines []string
+	lines = append(lines, bold+truncate("bittor · "+v.Torrent.Name, width))
+	lines = append(lines, progressBar(st, width))
+
+	percent := 0.0
+	if st.Pieces > 0 {
+		percent = float64(st.Done) / float64(st.Pieces) * 100
+	}
+	eta := "ETA " + formatDuration(st.ETA())
+	if st.Complete {
+		eta = green + "complete" + reset
+	}
+	lines = append(lines, truncate(fmt.Sprintf("%5.1f%%  %d/%d pieces  %s of %s  ", percent, st.Done, st.Pieces,
+		formatBytes(float64(st.Downloaded)), formatBytes(float64(st.Length))), width)+eta)
+
+	failures := fmt.Sprintf("hash failures %d", st.HashFailures)
+	if st.HashFailures > 0 {
+		failures = red + failures + reset
+	}
+	elapsed := ""
+	if !st.Started.IsZero() {
+		elapsed = "  elapsed " + formatDuration(time.Since(st.Started))
+	}
+	lines = append(lines, fmt.Sprintf("down %s  up %s  uploaded %s  peers %d  %s%s",
+		formatRate(st.Rate), formatRate(st.UploadRate), formatBytes(float64(st.Uploaded)), st.Peers, failures, elapsed))
+	lines = append(lines, trackerLine(tracker, width))
+	lines = append(lines, "")
+
+	lines = append(lines, bold+"pieces"+reset+dim+"  "+green+"█"+reset+dim+" done  "+yellow+"▒"+reset+dim+" downloading  · missing")
+	lines = append(lines, pieceMap(pieces, width, maxMapRows)...)
+	lines = append(lines, "")
+
+	// peers get what's left after the log and the key help
+	room := height - len(lines) - 1 - logLines - 2
+	lines = append(lines, bold+fmt.Sprintf("peers (by %s)", sortNames[order]))
+	lines = append(lines, peerTable(peers, st.Pieces, order, width, room)...)
+
+	if v.Log != nil {
+		lines = append(lines, "")
+		for _, l := range v.Log.Lines(logLines) {
+			lines = append(lines, dim+truncate(l, width))
+		}
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, dim+"q quit  s sort peers")
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	return lines
+}
+
+func progressBar(st p2p.Stats, width int) string {
+	n := width
+	done := 0
+	if st.Pieces > 0 {
+		done = n * st.Done / st.Pieces
+	}
+	return green + strings.Repeat("━", done) + reset + dim + strings.Repeat("━", n-done)
+}
+
+func trackerLine(tr Tracker, width int) string {
+	switch {
+	case tr.Host == "":
+		return dim + "tracker none"
+	case tr.Err != nil:
+		return red + truncate(fmt.Sprintf("tracker %s: %v", tr.Host, tr.Err), width)
+	default:
+		ago := formatDuration(time.Since(tr.Announced))
+		return truncate(fmt.Sprintf("tracker %s: %d peers, announced %s ago", tr.Host, tr.Peers, ago), width)
+	}
+}
+
+// draws pieces into at most rows lines. With more pieces than cells each
+// cell stands for a run of pieces, full when all are done
+func pieceMap(pieces []p2p.PieceState, width, rows int) []string {
+	if len(pieces) == 0 || width <= 0 {
+		return nil
+	}
+	cells := min(len(pieces), width*rows)
+	per := (len(pieces) + cells - 1) / cells
+	cells = (len(pieces) + per - 1) / per
+
+	var lines []string
+	var b strings.Builder
+	for cell := range cells {
+		group := pieces[cell*per : min((cell+1)*per, len(pieces))]
+		var done, active int
+		for _, p := range group {
+			switch p {
+			case p2p.PieceDone:
+				done++
+			case p2p.PieceActive:
+				active++
+			}
+		}
+		switch {
+		case done == len(group):
+			b.WriteString(green + "█")
+		case active > 0:
+			b.WriteString(yellow + "▒")
+		case done > 0:
+			b.WriteString(green + "▓")
+		default:
+			b.WriteString(dim + "·")
+		}
+		if (cell+1)%width == 0 || cell == cells-1 {
+			lines = append(lines, b.String())
+			b.Reset()
+		}
+	}
+	return lines
+}
+
+func peerTable(peers []p2p.PeerStats, total, order, width, rows int) []string {
+	switch order {
+	case sortUp:
+		sort.SliceStable(peers, func(i, j int) bool { return peers[i].UploadRate > peers[j].UploadRate })
+	case sortAddr:
+		sort.SliceStable(peers, func(i, j int) bool { return peers[i].Addr < peers[j].Addr })
+	}
+
+	lines := []string{dim + truncate(fmt.Sprintf("%-22s %11s %11s %7s  %-8s %-8s %s",
+		"ADDRESS", "DOWN", "UP", "HAVE", "FROM", "TO", "WANTS"), width)}
+	if rows < 2 {
+		return lines
+	}
+	shown := peers
+	if len(shown) > rows-1 {
+		shown = shown[:rows-2]
+	}
+	for _, p := range shown {
+		have := 0.0
+		if total > 0 {
+			have = float64(p.Pieces) / float64(total) * 100
+		}
+		lines = append(lines, truncate(fmt.Sprintf("%-22s %11s %11s %6.1f%%  %-8s %-8s %s",
+			p.Addr, formatRate(p.DownloadRate), formatRate(p.UploadRate), have,
+			chokeState(p.PeerChoking), chokeState(p.AmChoking), yesNo(p.PeerInterested)), width))
+	}
+	if len(shown) < len(peers) {
+		lines = append(lines, dim+fmt.Sprintf("… %d more", len(peers)-len(shown)))
+	}
+	return lines
+}
+
+func chokeState(choked bool) string {
+	if choked {
+		return "choked"
+	}
+	return "open"
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
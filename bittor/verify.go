@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bittor/torfile"
+	"bittor/verify"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+// hashes existing data against the torrent and reports what is complete.
+// Exits with status 1 when anything is missing or corrupt
+func verifyCmd(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print a machine readable report")
+	workers := fs.Int("workers", 0, "hashing workers, one per CPU when 0")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: bittor verify [flags] <torrent> <path>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	tf, err := torfile.Read(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	rep, err := verify.Path(ctx, &tf, fs.Arg(1), *workers)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rep); err != nil {
+			return err
+		}
+	} else {
+		printReport(rep)
+	}
+
+	if !rep.Done() {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func printReport(rep *verify.Report) {
+	percent := float64(rep.Complete) / float64(rep.Pieces) * 100
+	fmt.Printf("%s (%s)\n", rep.Name, rep.InfoHash)
+	fmt.Printf("pieces: %d/%d complete (%0.2f%%), %d corrupt, %d missing\n",
+		rep.Complete, rep.Pieces, percent, len(rep.Corrupt), len(rep.Missing))
+	for _, f := range rep.Files {
+		fmt.Printf("  %-10s %5d/%-5d %s\n", f.Status, f.Complete, f.Pieces, f.Path)
+	}
+}
@@ -0,0 +1,219 @@
+// Package verify hashes existing torrent data against its piece hashes
+package verify
+
+import (
+	"bittor/bitfield"
+	"bittor/p2p"
+	"bittor/storage"
+	"bittor/torfile"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+type Status string
+
+const (
+	StatusComplete Status = "complete"
+	StatusCorrupt  Status = "corrupt"
+	StatusMissing  Status = "missing"
+	// file exists but some of its pieces are missing or corrupt
+	StatusIncomplete Status = "incomplete"
+)
+
+// FileReport is the verification state of a single payload file
+type FileReport struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+	Status Status `json:"status"`
+	// pieces overlapping the file and how many of them verified
+	Pieces   int `json:"pieces"`
+	Complete int `json:"complete"`
+}
+
+// Report is the result of hashing a torrent's data
+type Report struct {
+	Name     string `json:"name"`
+	InfoHash string `json:"info_hash"`
+	Pieces   int    `json:"pieces"`
+	Complete int    `json:"complete"`
+	// indices of pieces that hashed wrong or couldn't be read
+	Corrupt []int        `json:"corrupt"`
+	Missing []int        `json:"missing"`
+	Files   []FileReport `json:"files"`
+	// verified pieces, for resuming or seeding
+	Have bitfield.Bitfield `json:"-"`
+	// status of each piece
+	Status []Status `json:"-"`
+}
+
+// Done reports whether every piece verified and every file is there
+func (r *Report) Done() bool {
+	for _, f := range r.Files {
+		if f.Status != StatusComplete {
+			return false
+		}
+	}
+	return r.Complete == r.Pieces
+}
+
+// Path verifies data laid out on disk the way downloads write it: the file
+// itself for single file torrents, the torrent's top directory for multi
+// file torrents. workers <= 0 uses one hashing worker per CPU
+func Path(ctx context.Context, tf *torfile.File, root string, workers int) (*Report, error) {
+	st := storage.ReadFiles(tf.Spans(root), tf.Layout())
+	defer st.Close()
+	rep, err := Reader(ctx, tf, st, workers)
+	if err != nil {
+		return nil, err
+	}
+	// empty files have no pieces to read, only opening them tells
+	// whether they are there
+	for i, f := range tf.Files {
+		if f.Length == 0 && !st.Exists(i) {
+			rep.Files[i].Status = StatusMissing
+		}
+	}
+	return rep, nil
+}
+
+// Reader verifies data read from r laid out as the contiguous payload
+func Reader(ctx context.Context, tf *torfile.File, r io.ReaderAt, workers int) (*Report, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	total := len(tf.PieceHashes)
+	status := make([]Status, total)
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, tf.PieceLength)
+			for idx := range jobs {
+				status[idx] = checkPiece(tf, r, idx, buf)
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for idx := range total {
+		select {
+		case jobs <- idx:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return buildReport(tf, status), nil
+}
+
+func checkPiece(tf *torfile.File, r io.ReaderAt, idx int, buf []byte) Status {
+	begin := idx * tf.PieceLength
+	length := min(tf.PieceLength, tf.Length-begin)
+	buf = buf[:length]
+
+	if _, err := r.ReadAt(buf, int64(begin)); err != nil {
+		// short files and missing files both mean the data isn't there
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, os.ErrNotExist) {
+			return StatusMissing
+		}
+		return StatusCorrupt
+	}
+	if sha1.Sum(buf) != tf.PieceHashes[idx] {
+		return StatusCorrupt
+	}
+	return StatusComplete
+}
+
+func buildReport(tf *torfile.File, status []Status) *Report {
+	rep := &Report{
+		Name:     tf.Name,
+		InfoHash: hex.EncodeToString(tf.InfoHash[:]),
+		Pieces:   len(status),
+		Corrupt:  []int{},
+		Missing:  []int{},
+		Have:     make(bitfield.Bitfield, (len(status)+7)/8),
+		Status:   status,
+	}
+	for idx, st := range status {
+		switch st {
+		case StatusComplete:
+			rep.Complete++
+			rep.Have.SetPiece(idx)
+		case StatusCorrupt:
+			rep.Corrupt = append(rep.Corrupt, idx)
+		case StatusMissing:
+			rep.Missing = append(rep.Missing, idx)
+		}
+	}
+
+	for _, f := range tf.Files {
+		fr := FileReport{Path: f.Path, Length: f.Length}
+		var missing, corrupt int
+		if f.Length > 0 {
+			first, last := f.Offset/tf.PieceLength, (f.Offset+f.Length-1)/tf.PieceLength
+			for idx := first; idx <= last; idx++ {
+				fr.Pieces++
+				switch status[idx] {
+				case StatusComplete:
+					fr.Complete++
+				case StatusCorrupt:
+					corrupt++
+				case StatusMissing:
+					missing++
+				}
+			}
+		}
+
+		switch {
+		case fr.Complete == fr.Pieces:
+			fr.Status = StatusComplete
+		case missing == fr.Pieces:
+			fr.Status = StatusMissing
+		case corrupt > 0 && missing == 0:
+			fr.Status = StatusCorrupt
+		default:
+			fr.Status = StatusIncomplete
+		}
+		rep.Files = append(rep.Files, fr)
+	}
+	return rep
+}
+
+// Resume hashes data a previous run left at path, laid out as DownloadTo
+// writes it, and marks the verified pieces on tor so only the rest is
+// fetched. Nil without error when none of the files exist
+func Resume(ctx context.Context, tf *torfile.File, tor *p2p.Torrent, path string) (*Report, error) {
+	st := storage.ReadFiles(tf.Spans(path), tf.Layout())
+	defer st.Close()
+	found := false
+	for i := range tf.Files {
+		found = found || st.Exists(i)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	rep, err := Reader(ctx, tf, st, 0)
+	if err != nil {
+		return nil, err
+	}
+	tor.SetHave(rep.Have)
+	return rep, nil
+}
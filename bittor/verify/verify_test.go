@@ -0,0 +1,107 @@
+package verify_test
+
+import (
+	"bittor/storage"
+	"bittor/swarmtest"
+	"bittor/verify"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a multi file torrent downloads into a directory tree that verify, resume
+// and seeding read back the same way
+func TestMultiFileRoundTrip(t *testing.T) {
+	const pieceLength = 16 << 10
+	// files shorter than a piece, spanning pieces and empty
+	lengths := []int{5000, 40 << 10, 0, 3, 30 << 10}
+	total := 0
+	for _, n := range lengths {
+		total += n
+	}
+	s, err := swarmtest.NewFiles(swarmtest.Data(total, 7), lengths, pieceLength, swarmtest.SeederConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tf := s.File
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tor, err := s.Torrent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(t.TempDir(), "out")
+	if err := tf.DownloadTo(ctx, tor, root, 6881); err != nil {
+		t.Fatal(err)
+	}
+
+	off := 0
+	for i, n := range lengths {
+		got, err := os.ReadFile(filepath.Join(root, fmt.Sprintf("file%d.bin", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, s.Data[off:off+n]) {
+			t.Fatalf("file %d differs from its part of the payload", i)
+		}
+		off += n
+	}
+
+	rep, err := verify.Path(ctx, &tf, root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Done() {
+		t.Fatalf("verify of the download: %+v", rep)
+	}
+
+	resumed := tf.Torrent(tor.PeerID)
+	if rep, err = verify.Resume(ctx, &tf, resumed, root); err != nil {
+		t.Fatal(err)
+	}
+	if st := resumed.Stats(); rep == nil || !st.Complete {
+		t.Fatalf("resume found %d/%d pieces", st.Done, st.Pieces)
+	}
+
+	// what seeding reads
+	st := storage.ReadFiles(tf.Spans(root), tf.Layout())
+	defer st.Close()
+	got := make([]byte, total)
+	if _, err := st.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, s.Data) {
+		t.Fatal("read back payload differs")
+	}
+
+	// files go missing, only their pieces are lost
+	for _, name := range []string{"file2.bin", "file3.bin"} {
+		if err := os.Remove(filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rep, err = verify.Path(ctx, &tf, root, 0); err != nil {
+		t.Fatal(err)
+	}
+	// file3 is three bytes inside the piece shared with the ends of file1
+	// and file4
+	want := []verify.Status{verify.StatusComplete, verify.StatusIncomplete, verify.StatusMissing, verify.StatusMissing, verify.StatusIncomplete}
+	for i, f := range rep.Files {
+		if f.Status != want[i] {
+			t.Errorf("file %d is %s, want %s", i, f.Status, want[i])
+		}
+	}
+	if rep.Done() || len(rep.Missing) != 1 {
+		t.Fatalf("missing pieces %v", rep.Missing)
+	}
+
+	if rep, err := verify.Resume(ctx, &tf, tf.Torrent(tor.PeerID), filepath.Join(t.TempDir(), "nothing")); err != nil || rep != nil {
+		t.Fatalf("resume without data: %+v, %v", rep, err)
+	}
+}
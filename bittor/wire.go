@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bittor/wire"
+	"fmt"
+)
+
+// prints a recorded peer connection one frame per line
+func dumpWire(path string) error {
+	h, recs, err := wire.ReadFile(path)
+	if h.Start.IsZero() {
+		// not even the header could be read
+		return err
+	}
+	fmt.Printf("%s -> %s at %s, %d frames\n", h.Local, h.Remote, h.Start.Format("2006-01-02 15:04:05.000"), len(recs))
+	for _, rec := range recs {
+		fmt.Println(rec.Summary(h.Start))
+	}
+	return err
+}
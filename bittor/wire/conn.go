@@ -0,0 +1,164 @@
+package wire
+
+import (
+	"bittor/handshake"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recorder writes one recording per connection into Dir. A nil Recorder
+// records nothing
+type Recorder struct {
+	Dir string
+}
+
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Recorder{Dir: dir}, nil
+}
+
+// Wrap returns conn with its traffic recorded, starting with the handshakes.
+// remote is the peer's handshake when a listener already read it off conn.
+// Recording is best effort, conn is returned as is when the file can't be
+// created
+func (r *Recorder) Wrap(conn net.Conn, remote *handshake.Handshake) net.Conn {
+	if r == nil {
+		return conn
+	}
+
+	start := time.Now()
+	name := fmt.Sprintf("%s_%s.wire", start.Format("20060102T150405.000000"), conn.RemoteAddr())
+	name = strings.NewReplacer(":", "-", "[", "", "]", "").Replace(name)
+	f, err := os.Create(filepath.Join(r.Dir, name))
+	if err != nil {
+		log.Printf("wire recording disabled for %s: %v", conn.RemoteAddr(), err)
+		return conn
+	}
+	h := Header{Start: start, Local: conn.LocalAddr().String(), Remote: conn.RemoteAddr().String()}
+	if err := writeHeader(f, h); err != nil {
+		f.Close()
+		log.Printf("wire recording disabled for %s: %v", conn.RemoteAddr(), err)
+		return conn
+	}
+
+	rc := &recordingConn{Conn: conn, f: f}
+	rc.in.dir, rc.out.dir = In, Out
+	if remote != nil {
+		rc.record(Record{Time: start, Direction: In, Kind: KindHandshake, Data: remote.Serialize()})
+		rc.in.handshook = true
+	}
+	return rc
+}
+
+// splits one direction of the byte stream into handshake and message frames
+type framer struct {
+	dir       Direction
+	handshook bool
+	buf       []byte
+	// set once a frame was too large to buffer, the rest isn't recorded
+	lost bool
+}
+
+// appends p and returns the frames it completed
+func (fr *framer) feed(p []byte) []Record {
+	if fr.lost {
+		return nil
+	}
+	fr.buf = append(fr.buf, p...)
+	var recs []Record
+	for {
+		n, kind := fr.frameLen()
+		if n > maxRecord {
+			log.Printf("wire recording lost sync on a %d byte frame", n)
+			fr.lost, fr.buf = true, nil
+			return recs
+		}
+		if n == 0 || len(fr.buf) < n {
+			return recs
+		}
+		recs = append(recs, Record{Time: time.Now(), Direction: fr.dir, Kind: kind, Data: append([]byte(nil), fr.buf[:n]...)})
+		fr.buf = fr.buf[n:]
+		if kind == KindHandshake {
+			fr.handshook = true
+		}
+	}
+}
+
+// length of the next frame, 0 while its header is incomplete
+func (fr *framer) frameLen() (int, Kind) {
+	if !fr.handshook {
+		if len(fr.buf) < 1 {
+			return 0, KindHandshake
+		}
+		// pstrlen, pstr, reserved, info hash, peer id
+		return 1 + int(fr.buf[0]) + 48, KindHandshake
+	}
+	if len(fr.buf) < 4 {
+		return 0, KindMessage
+	}
+	return 4 + int(binary.BigEndian.Uint32(fr.buf)), KindMessage
+}
+
+type recordingConn struct {
+	net.Conn
+
+	// only touched by the one goroutine reading or writing respectively
+	in, out framer
+
+	mu     sync.Mutex
+	f      *os.File
+	failed bool
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		for _, rec := range c.in.feed(p[:n]) {
+			c.record(rec)
+		}
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		for _, rec := range c.out.feed(p[:n]) {
+			c.record(rec)
+		}
+	}
+	return n, err
+}
+
+func (c *recordingConn) record(rec Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil || c.failed {
+		return
+	}
+	if _, err := c.f.Write(encodeRecord(rec)); err != nil {
+		// the connection itself is fine, only stop recording it
+		log.Printf("wire recording of %s stopped: %v", c.RemoteAddr(), err)
+		c.failed = true
+	}
+}
+
+func (c *recordingConn) Close() error {
+	err := c.Conn.Close()
+	c.mu.Lock()
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+	c.mu.Unlock()
+	return err
+}
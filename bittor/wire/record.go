@@ -0,0 +1,234 @@
+// Package wire records peer wire traffic to a file and replays recorded
+// sessions, to see exactly what a misbehaving peer sent
+package wire
+
+import (
+	"bittor/handshake"
+	"bittor/message"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// file layout, all integers big endian:
+//
+//	header: magic (6) version (2) start unix nanos (8)
+//	        local addr, remote addr (2 byte length + bytes each)
+//	record: unix nanos (8) direction (1) kind (1) length (4) data
+//
+// handshake records hold the raw handshake, message records the whole frame
+// including its length prefix, so a keep-alive is four zero bytes
+const (
+	magic   = "BTWIRE"
+	version = 1
+
+	// largest record accepted when reading, a piece message with room to spare
+	maxRecord = 1 << 20
+)
+
+var ErrFormat = errors.New("not a wire recording")
+
+type Direction uint8
+
+const (
+	// received from the remote peer
+	In Direction = iota
+	// sent by us
+	Out
+)
+
+func (d Direction) String() string {
+	if d == In {
+		return "<-"
+	}
+	return "->"
+}
+
+type Kind uint8
+
+const (
+	KindHandshake Kind = iota
+	KindMessage
+)
+
+// Header describes the recorded connection
+type Header struct {
+	Start  time.Time
+	Local  string
+	Remote string
+}
+
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	Kind      Kind
+	Data      []byte
+}
+
+// Handshake decodes a handshake record
+func (r Record) Handshake() (*handshake.Handshake, error) {
+	if r.Kind != KindHandshake {
+		return nil, fmt.Errorf("record is a %d, not a handshake", r.Kind)
+	}
+	return handshake.Read(bytes.NewReader(r.Data))
+}
+
+// Message decodes a message record, nil for a keep-alive
+func (r Record) Message() (*message.Message, error) {
+	if r.Kind != KindMessage {
+		return nil, errors.New("record is a handshake, not a message")
+	}
+	return message.Read(bytes.NewReader(r.Data))
+}
+
+func (r Record) keepAlive() bool {
+	return r.Kind == KindMessage && len(r.Data) == 4 && binary.BigEndian.Uint32(r.Data) == 0
+}
+
+// Summary is a one line description of the record relative to start
+func (r Record) Summary(start time.Time) string {
+	return fmt.Sprintf("%10.3fs %s %s", r.Time.Sub(start).Seconds(), r.Direction, r.describe())
+}
+
+func (r Record) describe() string {
+	if r.Kind == KindHandshake {
+		hs, err := r.Handshake()
+		if err != nil {
+			return fmt.Sprintf("Handshake malformed: %v", err)
+		}
+		return fmt.Sprintf("Handshake info_hash=%x peer_id=%q", hs.InfoHash, hs.PeerID[:])
+	}
+
+	msg, err := r.Message()
+	if err != nil {
+		return fmt.Sprintf("Message malformed: %v", err)
+	}
+	if msg == nil {
+		return "KeepAlive"
+	}
+	u32 := func(i int) uint32 {
+		if len(msg.Payload) < i+4 {
+			return 0
+		}
+		return binary.BigEndian.Uint32(msg.Payload[i:])
+	}
+	switch msg.ID {
+	case message.MsgHave:
+		return fmt.Sprintf("Have piece=%d", u32(0))
+	case message.MsgRequest:
+		return fmt.Sprintf("Request piece=%d begin=%d length=%d", u32(0), u32(4), u32(8))
+	case message.MsgCancel:
+		return fmt.Sprintf("Cancel piece=%d begin=%d length=%d", u32(0), u32(4), u32(8))
+	case message.MsgPiece:
+		return fmt.Sprintf("Piece piece=%d begin=%d length=%d", u32(0), u32(4), max(len(msg.Payload)-8, 0))
+	default:
+		return msg.String()
+	}
+}
+
+func writeHeader(w io.Writer, h Header) error {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	binary.Write(&buf, binary.BigEndian, uint16(version))
+	binary.Write(&buf, binary.BigEndian, h.Start.UnixNano())
+	for _, s := range []string{h.Local, h.Remote} {
+		binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+		buf.WriteString(s)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func encodeRecord(r Record) []byte {
+	buf := make([]byte, 14+len(r.Data))
+	binary.BigEndian.PutUint64(buf, uint64(r.Time.UnixNano()))
+	buf[8], buf[9] = byte(r.Direction), byte(r.Kind)
+	binary.BigEndian.PutUint32(buf[10:], uint32(len(r.Data)))
+	copy(buf[14:], r.Data)
+	return buf
+}
+
+// Reader reads a recording record by record
+type Reader struct {
+	Header Header
+	r      *bufio.Reader
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	fixed := make([]byte, len(magic)+2+8)
+	if _, err := io.ReadFull(br, fixed); err != nil || string(fixed[:len(magic)]) != magic {
+		return nil, ErrFormat
+	}
+	if v := binary.BigEndian.Uint16(fixed[len(magic):]); v != version {
+		return nil, fmt.Errorf("unsupported wire recording version %d", v)
+	}
+
+	rd := &Reader{r: br}
+	rd.Header.Start = time.Unix(0, int64(binary.BigEndian.Uint64(fixed[len(magic)+2:])))
+	for _, s := range []*string{&rd.Header.Local, &rd.Header.Remote} {
+		var n uint16
+		if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+			return nil, ErrFormat
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, ErrFormat
+		}
+		*s = string(b)
+	}
+	return rd, nil
+}
+
+// Next returns the next record, io.EOF after the last one. A recording cut
+// short by a crash ends with io.ErrUnexpectedEOF
+func (rd *Reader) Next() (Record, error) {
+	fixed := make([]byte, 14)
+	if _, err := io.ReadFull(rd.r, fixed); err != nil {
+		return Record{}, err
+	}
+	n := binary.BigEndian.Uint32(fixed[10:])
+	if n > maxRecord {
+		return Record{}, fmt.Errorf("record of %d bytes exceeds limit", n)
+	}
+	rec := Record{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(fixed))),
+		Direction: Direction(fixed[8]),
+		Kind:      Kind(fixed[9]),
+		Data:      make([]byte, n),
+	}
+	if _, err := io.ReadFull(rd.r, rec.Data); err != nil {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+	return rec, nil
+}
+
+// ReadFile loads a whole recording
+func ReadFile(path string) (Header, []Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	defer f.Close()
+
+	rd, err := NewReader(f)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	var recs []Record
+	for {
+		rec, err := rd.Next()
+		if err == io.EOF {
+			return rd.Header, recs, nil
+		}
+		if err != nil {
+			return rd.Header, recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
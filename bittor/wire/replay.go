@@ -0,0 +1,220 @@
+package wire
+
+import (
+	"bittor/bitfield"
+	"bittor/client"
+	"bittor/message"
+	"bittor/peer"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// MismatchError reports the first frame the client sent that differs from
+// the recording
+type MismatchError struct {
+	Index int
+	Want  Record
+	Got   Record
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("record %d: expected %s, client sent %s", e.Index, e.Want.describe(), e.Got.describe())
+}
+
+// Player plays the remote peer of a recorded session over an in memory
+// connection. Frames the peer sent are written in recorded order, frames we
+// sent are expected from the client before playback continues, so the
+// client sees the same conversation on every run. Keep-alives we sent are
+// timing dependent and not required
+type Player struct {
+	// Timing waits out the recorded gaps before frames from the peer
+	Timing bool
+
+	records []Record
+	// records already consumed outside the player, e.g. an accepted handshake
+	skip  int
+	conn  net.Conn
+	local net.Conn
+	done  chan struct{}
+	err   error
+}
+
+func NewPlayer(records []Record) *Player {
+	local, remote := net.Pipe()
+	return &Player{records: records, conn: remote, local: local, done: make(chan struct{})}
+}
+
+// Conn is the client's end of the connection
+func (p *Player) Conn() net.Conn {
+	return p.local
+}
+
+// Start plays the session in the background until it ends, diverges or ctx
+// is done. The connection is closed afterwards like the recorded one was
+func (p *Player) Start(ctx context.Context) {
+	go func() {
+		defer close(p.done)
+		stop := context.AfterFunc(ctx, func() { p.conn.Close() })
+		defer stop()
+		p.err = p.play(ctx)
+		p.conn.Close()
+	}()
+}
+
+// Wait returns nil when the whole recording was played back
+func (p *Player) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *Player) play(ctx context.Context) error {
+	var last time.Time
+	for i := p.skip; i < len(p.records); i++ {
+		rec := p.records[i]
+		if rec.Direction == In {
+			if p.Timing && !last.IsZero() {
+				select {
+				case <-time.After(rec.Time.Sub(last)):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			last = rec.Time
+			if _, err := p.conn.Write(rec.Data); err != nil {
+				return fmt.Errorf("record %d: %w", i, err)
+			}
+			continue
+		}
+		if rec.keepAlive() {
+			continue
+		}
+
+		got, err := p.readFrame(rec.Kind)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("record %d: waiting for %s: %w", i, rec.describe(), err)
+		}
+		if !bytes.Equal(got.Data, rec.Data) {
+			return &MismatchError{Index: i, Want: rec, Got: got}
+		}
+	}
+	return nil
+}
+
+// reads the client's next frame, skipping keep-alives
+func (p *Player) readFrame(kind Kind) (Record, error) {
+	for {
+		var data []byte
+		if kind == KindHandshake {
+			head := make([]byte, 1)
+			if _, err := io.ReadFull(p.conn, head); err != nil {
+				return Record{}, err
+			}
+			data = append(head, make([]byte, int(head[0])+48)...)
+			if _, err := io.ReadFull(p.conn, data[1:]); err != nil {
+				return Record{}, err
+			}
+		} else {
+			head := make([]byte, 4)
+			if _, err := io.ReadFull(p.conn, head); err != nil {
+				return Record{}, err
+			}
+			n := binary.BigEndian.Uint32(head)
+			if n > maxRecord {
+				return Record{}, fmt.Errorf("client sent a %d byte frame", n)
+			}
+			data = append(head, make([]byte, n)...)
+			if _, err := io.ReadFull(p.conn, data[4:]); err != nil {
+				return Record{}, err
+			}
+		}
+
+		rec := Record{Time: time.Now(), Direction: Out, Kind: kind, Data: data}
+		if !rec.keepAlive() {
+			return rec, nil
+		}
+	}
+}
+
+// Replay connects a client.Client to a playback of a recording the same way
+// the recorded connection was made: dialed when our handshake comes first,
+// accepted when the peer's does. Peer ids and info hash are taken from the
+// recorded handshakes so the client's frames match byte for byte
+func Replay(ctx context.Context, h Header, recs []Record) (*client.Client, *Player, error) {
+	var ours, theirs = -1, -1
+	for i, rec := range recs {
+		if rec.Kind != KindHandshake {
+			continue
+		}
+		if rec.Direction == Out && ours < 0 {
+			ours = i
+		}
+		if rec.Direction == In && theirs < 0 {
+			theirs = i
+		}
+	}
+	if ours < 0 || theirs < 0 {
+		return nil, nil, errors.New("recording has no complete handshake")
+	}
+	local, err := recs[ours].Handshake()
+	if err != nil {
+		return nil, nil, err
+	}
+	remote, err := recs[theirs].Handshake()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := NewPlayer(recs)
+	var c *client.Client
+	if theirs < ours {
+		// the listener read the peer's handshake before the client existed
+		p.skip = theirs + 1
+		p.Start(ctx)
+		c, err = client.Accept(p.Conn(), remote, local.PeerID, sentBitfield(recs[ours+1:]))
+	} else {
+		p.Start(ctx)
+		c, err = client.Handshake(ctx, p.Conn(), remotePeer(h.Remote), local.PeerID, local.InfoHash)
+	}
+	if err != nil {
+		p.Conn().Close()
+		if perr := p.Wait(); perr != nil {
+			err = fmt.Errorf("%w (playback: %v)", err, perr)
+		}
+		return nil, nil, err
+	}
+	return c, p, nil
+}
+
+// the bitfield we sent right after our handshake, if any
+func sentBitfield(recs []Record) bitfield.Bitfield {
+	for _, rec := range recs {
+		if rec.Direction != Out || rec.keepAlive() {
+			continue
+		}
+		msg, err := rec.Message()
+		if err != nil || msg == nil || msg.ID != message.MsgBitfield {
+			return nil
+		}
+		return msg.Payload
+	}
+	return nil
+}
+
+func remotePeer(addr string) peer.Peer {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return peer.Peer{}
+	}
+	n, _ := strconv.Atoi(port)
+	return peer.Peer{IP: net.ParseIP(host), Port: uint16(n)}
+}
@@ -0,0 +1,97 @@
+package wire_test
+
+import (
+	"bittor/client"
+	"bittor/message"
+	"bittor/swarmtest"
+	"bittor/wire"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testdata/dialed.wire is a download of piece 1 from a swarmtest seeder:
+// our handshake, theirs, their bitfield, interested, unchoke, one request
+// answered by its piece, and our have
+const (
+	dialedLength      = 2048
+	dialedSeed        = 40
+	dialedPieceLength = 1024
+)
+
+func replay(t *testing.T, path string) (*client.Client, *wire.Player) {
+	t.Helper()
+	h, recs, err := wire.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	c, p, err := wire.Replay(ctx, h, recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, p
+}
+
+// the next message played back
+func next(t *testing.T, c *client.Client, p *wire.Player) *message.Message {
+	t.Helper()
+	msg, err := c.Read(time.Now().Add(2 * time.Second))
+	if err != nil {
+		t.Fatalf("reading the next played back message: %v (playback: %v)", err, p.Wait())
+	}
+	return msg
+}
+
+// the recorded handshake was produced by handshake.Serialize, a client
+// serializing it differently fails the replay before any message
+func TestReplay(t *testing.T) {
+	c, p := replay(t, "testdata/dialed.wire")
+	if !c.Bitfield.HasPiece(0) || !c.Bitfield.HasPiece(1) {
+		t.Fatalf("replayed bitfield %08b, want pieces 0 and 1", c.Bitfield)
+	}
+
+	if err := c.SendInterested(); err != nil {
+		t.Fatal(err)
+	}
+	if msg := next(t, c, p); msg.ID != message.MsgUnchoke {
+		t.Fatalf("got %s, want unchoke", msg)
+	}
+	if err := c.SendRequest(1, 0, dialedPieceLength); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, dialedPieceLength)
+	if _, err := message.ParsePiece(1, buf, next(t, c, p)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, swarmtest.Data(dialedLength, dialedSeed)[dialedPieceLength:]) {
+		t.Fatal("replayed piece 1 differs from the recorded payload")
+	}
+	if err := c.SendHave(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	c, p := replay(t, "testdata/dialed.wire")
+	if err := c.SendInterested(); err != nil {
+		t.Fatal(err)
+	}
+	next(t, c, p)
+
+	// the recording asked for piece 1
+	if err := c.SendRequest(0, 0, dialedPieceLength); err != nil {
+		t.Fatal(err)
+	}
+	var mm *wire.MismatchError
+	if err := p.Wait(); !errors.As(err, &mm) || mm.Index != 5 {
+		t.Fatalf("got %v, want a mismatch at record 5", err)
+	}
+}
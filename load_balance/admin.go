@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type backendInfo struct {
+	URL      string `json:"url"`
+	Alive    bool   `json:"alive"`
+	Draining bool   `json:"draining"`
+	Weight   int    `json:"weight"`
+	InFlight int64  `json:"in_flight"`
+	// moving average, 0 before the first response
+	ResponseTimeMs float64 `json:"response_time_ms"`
+	Breaker        string  `json:"breaker"`
+}
+
+func (b *Backend) info() backendInfo {
+	return backendInfo{
+		URL:            b.url.String(),
+		Alive:          b.IsAlive(),
+		Draining:       b.draining.Load(),
+		Weight:         b.Weight(),
+		InFlight:       b.InFlight(),
+		ResponseTimeMs: float64(b.ResponseTime()) / float64(time.Millisecond),
+		Breaker:        b.breaker.State().String(),
+	}
+}
+
+// how often draining looks at the in flight count
+const drainPoll = 50 * time.Millisecond
+
+// stops new requests to b and waits until its in flight ones finished or
+// ctx is done
+func (b *Backend) drain(ctx context.Context) error {
+	b.draining.Store(true)
+	t := time.NewTicker(drainPoll)
+	defer t.Stop()
+	for b.InFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+type addBackendRequest struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+type drainRequest struct {
+	URL string `json:"url"`
+}
+
+type removeResponse struct {
+	URL string `json:"url"`
+	// false when requests were still in flight at the drain timeout, they
+	// finish anyway
+	Drained bool `json:"drained"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// adminHandler serves the JSON admin API
+//
+//	GET    /backends            list backends
+//	POST   /backends            add {"url": url, "weight": n}
+//	POST   /backends/drain      stop new requests to {"url": url}
+//	DELETE /backends?url=<url>  drain, waiting up to drainTimeout, and remove
+func adminHandler(drainTimeout time.Duration) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /backends", func(w http.ResponseWriter, r *http.Request) {
+		backends := serverPool.Backends()
+		infos := make([]backendInfo, 0, len(backends))
+		for _, be := range backends {
+			infos = append(infos, be.info())
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+
+	mux.HandleFunc("POST /backends", func(w http.ResponseWriter, r *http.Request) {
+		var req addBackendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		u, err := parseBackendURL(req.URL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Weight < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid weight %d", req.Weight))
+			return
+		}
+		be := newBackend(u, max(req.Weight, 1))
+		if !serverPool.AddBackend(be) {
+			writeError(w, http.StatusConflict, fmt.Errorf("backend %s already exists", u))
+			return
+		}
+		log.Printf("Admin added server: %s weight %d", u, be.Weight())
+		writeJSON(w, http.StatusCreated, be.info())
+	})
+
+	mux.HandleFunc("POST /backends/drain", func(w http.ResponseWriter, r *http.Request) {
+		var req drainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		be := serverPool.Backend(req.URL)
+		if be == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("backend %s not found", req.URL))
+			return
+		}
+		be.draining.Store(true)
+		log.Printf("Admin draining server: %s, %d in flight", be.url, be.InFlight())
+		writeJSON(w, http.StatusAccepted, be.info())
+	})
+
+	mux.HandleFunc("DELETE /backends", func(w http.ResponseWriter, r *http.Request) {
+		u := r.URL.Query().Get("url")
+		be := serverPool.Backend(u)
+		if be == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("backend %s not found", u))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), drainTimeout)
+		defer cancel()
+		err := be.drain(ctx)
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			// the admin client went away, the backend stays draining
+			return
+		}
+		if !serverPool.RemoveBackend(be) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("backend %s was removed meanwhile", u))
+			return
+		}
+		log.Printf("Admin removed server: %s, drained %t", be.url, err == nil)
+		writeJSON(w, http.StatusOK, removeResponse{URL: u, Drained: err == nil})
+	})
+
+	return mux
+}
+
+func parseBackendURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid backend url %q, want http(s)://host[:port]", s)
+	}
+	return u, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, adminError{Error: err.Error()})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForAdmitted(t *testing.T) {
+	b := testBackends(1)[0]
+	if !b.admit() {
+		t.Fatal("idle backend didn't admit a request")
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- b.drain(context.Background()) }()
+	// drain marks the backend first, later requests stay off it
+	for !b.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if b.admit() {
+		t.Fatal("draining backend admitted a request")
+	}
+	select {
+	case <-drained:
+		t.Fatal("drain returned with a request in flight")
+	case <-time.After(2 * drainPoll):
+	}
+
+	// what serve does when the request finished
+	b.inFlight.Add(-1)
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drain didn't return after the request finished")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type BreakerConfig struct {
+	// consecutive failures opening the breaker, 0 disables the trigger
+	ConsecutiveFailures int
+	// failure rate opening the breaker once a window saw MinRequests, 0
+	// disables the trigger
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration
+	// how long an open breaker rejects requests before probing
+	OpenTimeout time.Duration
+	// requests let through half-open, all of them must pass to close
+	Probes int
+}
+
+func (c *BreakerConfig) enabled() bool {
+	return c.ConsecutiveFailures > 0 || c.FailureRate > 0
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// breaker stops sending requests to a backend that keeps failing, then lets
+// a few probes through after OpenTimeout to see whether it recovered.
+// A nil breaker lets everything through
+type breaker struct {
+	cfg  *BreakerConfig
+	name string
+
+	mu          sync.Mutex
+	state       breakerState
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	// half-open probes sent and passed
+	probing, passed int
+}
+
+func newBreaker(cfg *BreakerConfig, name string) *breaker {
+	if !cfg.enabled() {
+		return nil
+	}
+	return &breaker{cfg: cfg, name: name}
+}
+
+func (b *breaker) State() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(time.Now())
+	return b.state
+}
+
+// open breakers turn half-open once their timeout passed, caller holds b.mu
+func (b *breaker) expire(now time.Time) {
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		b.setState(breakerHalfOpen, "probing")
+	}
+}
+
+// reports whether a request could be sent now, without taking a probe slot
+func (b *breaker) available() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(time.Now())
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		return b.probing < b.cfg.Probes
+	default:
+		return false
+	}
+}
+
+// admits a request, taking a probe slot when half-open
+func (b *breaker) acquire() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(time.Now())
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if b.probing >= b.cfg.Probes {
+			return false
+		}
+		b.probing++
+		return true
+	default:
+		return false
+	}
+}
+
+// gives back the probe slot of a request that ended without a verdict, e.g.
+// because the client went away
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = max(b.probing-1, 0)
+	}
+}
+
+// counts the result of an admitted request. Half-open every result counts
+// as a probe, stragglers sent before the breaker opened are rare enough
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+
+	switch b.state {
+	case breakerHalfOpen:
+		b.probing = max(b.probing-1, 0)
+		if failed {
+			b.trip(now, "probe failed")
+			return
+		}
+		b.passed++
+		if b.passed >= b.cfg.Probes {
+			b.setState(breakerClosed, "probes passed")
+		}
+	case breakerClosed:
+		if now.Sub(b.windowStart) > b.cfg.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+		b.failures++
+		b.consecutive++
+		switch {
+		case b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures:
+			b.trip(now, "consecutive failures")
+		case b.cfg.FailureRate > 0 && b.requests >= b.cfg.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= b.cfg.FailureRate:
+			b.trip(now, "failure rate")
+		}
+	}
+}
+
+// caller holds b.mu
+func (b *breaker) trip(now time.Time, reason string) {
+	b.openedAt = now
+	b.setState(breakerOpen, reason)
+}
+
+// caller holds b.mu
+func (b *breaker) setState(s breakerState, reason string) {
+	log.Printf("%s breaker %s -> %s: %s", b.name, b.state, s, reason)
+	b.state = s
+	b.consecutive, b.probing, b.passed = 0, 0, 0
+	b.windowStart, b.requests, b.failures = time.Time{}, 0, 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBreakerTrip(t *testing.T) {
+	consecutive := BreakerConfig{ConsecutiveFailures: 3, Window: time.Minute, OpenTimeout: time.Minute, Probes: 1}
+	rate := BreakerConfig{FailureRate: 0.5, MinRequests: 4, Window: time.Minute, OpenTimeout: time.Minute, Probes: 1}
+	tests := []struct {
+		name string
+		cfg  BreakerConfig
+		// true for a failed request
+		results []bool
+		want    breakerState
+	}{
+		{"consecutive", consecutive, []bool{true, true, true}, breakerOpen},
+		{"consecutive broken by a success", consecutive, []bool{true, true, false, true, true}, breakerClosed},
+		{"consecutive after a success", consecutive, []bool{false, true, true, true}, breakerOpen},
+		{"rate", rate, []bool{false, true, false, true}, breakerOpen},
+		{"rate below threshold", rate, []bool{true, false, false, false, false}, breakerClosed},
+		{"rate before min requests", rate, []bool{true, true, true}, breakerClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker(&tt.cfg, tt.name)
+			for _, failed := range tt.results {
+				if !b.acquire() {
+					t.Fatal("breaker rejected a request before the last result")
+				}
+				b.record(failed)
+			}
+			if got := b.State(); got != tt.want {
+				t.Fatalf("state %s, want %s", got, tt.want)
+			}
+			if b.available() != (tt.want == breakerClosed) {
+				t.Fatalf("available %t in state %s", b.available(), tt.want)
+			}
+		})
+	}
+}
+
+// a breaker that tripped long enough ago to probe
+func halfOpenBreaker(t *testing.T, probes int) *breaker {
+	t.Helper()
+	cfg := &BreakerConfig{ConsecutiveFailures: 1, Window: time.Minute, OpenTimeout: time.Minute, Probes: probes}
+	b := newBreaker(cfg, t.Name())
+	b.mu.Lock()
+	b.trip(time.Now().Add(-time.Hour), "test")
+	b.mu.Unlock()
+	if s := b.State(); s != breakerHalfOpen {
+		t.Fatalf("state %s, want half-open", s)
+	}
+	return b
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		// acquire, release, pass or fail
+		steps []string
+		// whether each acquire is admitted, in order
+		admitted []bool
+		want     breakerState
+	}{
+		{"probes run out", []string{"acquire", "acquire", "acquire"}, []bool{true, true, false}, breakerHalfOpen},
+		{"probes pass", []string{"acquire", "acquire", "pass", "pass"}, []bool{true, true}, breakerClosed},
+		{"one pass isn't enough", []string{"acquire", "acquire", "pass"}, []bool{true, true}, breakerHalfOpen},
+		{"probe fails", []string{"acquire", "pass", "acquire", "fail"}, []bool{true, true}, breakerOpen},
+		{"release frees a slot", []string{"acquire", "acquire", "release", "acquire", "acquire"}, []bool{true, true, true, false}, breakerHalfOpen},
+		{"passed probe frees a slot", []string{"acquire", "acquire", "pass", "acquire"}, []bool{true, true, true}, breakerHalfOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := halfOpenBreaker(t, 2)
+			var admitted []bool
+			for _, step := range tt.steps {
+				switch step {
+				case "acquire":
+					admitted = append(admitted, b.acquire())
+				case "release":
+					b.release()
+				case "pass", "fail":
+					b.record(step == "fail")
+				}
+			}
+			if len(admitted) != len(tt.admitted) {
+				t.Fatalf("admitted %v, want %v", admitted, tt.admitted)
+			}
+			for i := range admitted {
+				if admitted[i] != tt.admitted[i] {
+					t.Fatalf("admitted %v, want %v", admitted, tt.admitted)
+				}
+			}
+			if got := b.State(); got != tt.want {
+				t.Fatalf("state %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// a client hanging up on a probe gives its slot back without a verdict
+func TestServeClientCancelReleasesProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	be := newBackend(u, 1)
+	be.breaker = halfOpenBreaker(t, 1)
+
+	if !be.admit() {
+		t.Fatal("half-open backend didn't admit a probe")
+	}
+	if be.admit() {
+		t.Fatal("admitted more probes than configured")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	be.serve(httptest.NewRecorder(), r)
+
+	if be.InFlight() != 0 {
+		t.Fatalf("%d in flight after serve returned", be.InFlight())
+	}
+	if s := be.breaker.State(); s != breakerHalfOpen {
+		t.Fatalf("state %s after a cancelled probe, want half-open", s)
+	}
+	if !be.admit() {
+		t.Fatal("cancelled probe kept its slot")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// points each unit of backend weight gets on the ring
+const ringReplicas = 100
+
+// HashKey is the request attribute requests are hashed on
+type HashKey struct {
+	// "ip", "header" or "cookie"
+	Source string
+	// header or cookie name
+	Name string
+}
+
+// ParseHashKey reads ip, header:<name> or cookie:<name>
+func ParseHashKey(s string) (HashKey, error) {
+	source, name, _ := strings.Cut(s, ":")
+	switch {
+	case source == "ip" && name == "":
+	case (source == "header" || source == "cookie") && name != "":
+	default:
+		return HashKey{}, fmt.Errorf("invalid hash key %q, want ip, header:<name> or cookie:<name>", s)
+	}
+	return HashKey{Source: source, Name: name}, nil
+}
+
+// value of the key in r, the client IP when the header or cookie is missing
+func (k HashKey) value(r *http.Request) string {
+	switch k.Source {
+	case "header":
+		if v := r.Header.Get(k.Name); v != "" {
+			return v
+		}
+	case "cookie":
+		if c, err := r.Cookie(k.Name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return clientIP(r)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// fnv alone clusters similar keys like "host#1", "host#2", the splitmix64
+// finalizer spreads them over the ring
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+// consistentHash maps keys onto a ring of virtual nodes for every backend in
+// the pool. A key goes to the first backend clockwise from it that can take
+// the request, so when one is down or was tried already just the keys it
+// owned move on and everyone else stays put. The ring is only rebuilt when
+// backends are added or removed
+type consistentHash struct {
+	key HashKey
+
+	mu   sync.RWMutex
+	ring []ringPoint
+}
+
+func (s *consistentHash) Next(alive []*Backend, r *http.Request) *Backend {
+	if len(alive) == 0 {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h := hashString(s.key.value(r))
+	start := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	for i := range s.ring {
+		if b := s.ring[(start+i)%len(s.ring)].backend; slices.Contains(alive, b) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (s *consistentHash) setBackends(all []*Backend) {
+	ring := make([]ringPoint, 0, len(all)*ringReplicas)
+	for _, b := range all {
+		id := b.url.String()
+		for i := range b.Weight() * ringReplicas {
+			ring = append(ring, ringPoint{hash: hashString(id + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	s.mu.Lock()
+	s.ring = ring
+	s.mu.Unlock()
+}
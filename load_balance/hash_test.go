@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func testBackends(n int) []*Backend {
+	backends := make([]*Backend, n)
+	for i := range backends {
+		backends[i] = &Backend{url: &url.URL{Scheme: "http", Host: fmt.Sprintf("10.0.0.%d:80", i+1)}, alive: true}
+	}
+	return backends
+}
+
+func TestConsistentHashSkipsUnavailable(t *testing.T) {
+	all := testBackends(4)
+	s := &consistentHash{key: HashKey{Source: "header", Name: "X-Key"}}
+	s.setBackends(all)
+
+	owner := map[string]*Backend{}
+	for i := range 200 {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Key", fmt.Sprint(i))
+		owner[fmt.Sprint(i)] = s.Next(all, r)
+	}
+
+	// the second backend is down or was tried, only its keys move
+	down := all[1]
+	alive := slices.Delete(slices.Clone(all), 1, 2)
+	moved := 0
+	for key, b := range owner {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Key", key)
+		got := s.Next(alive, r)
+		switch {
+		case got == down:
+			t.Fatalf("key %s went to the unavailable backend", key)
+		case b != down && got != b:
+			t.Fatalf("key %s moved from %s to %s", key, b.url, got.url)
+		case b == down:
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no key was owned by the second backend")
+	}
+
+	if s.Next(nil, httptest.NewRequest("GET", "/", nil)) != nil {
+		t.Fatal("picked a backend with none available")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheck probes every backend over HTTP
+type HealthCheck struct {
+	// requested relative to the backend url
+	Path string
+	// status codes counting as healthy, inclusive
+	StatusMin, StatusMax int
+	// substring the response body must contain, ignored when empty
+	Body     string
+	Timeout  time.Duration
+	Interval time.Duration
+	// consecutive passes before a down backend is up again and failures
+	// before an up backend goes down
+	Rise, Fall int
+}
+
+// PassiveCheck takes a backend down when too many proxied requests fail
+// with a 5xx or a connection error. Active checks bring it back
+type PassiveCheck struct {
+	Window time.Duration
+	// requests a window needs before its failure rate counts
+	MinRequests int
+	// failure rate taking a backend down, 0 disables passive checks
+	MaxFailureRate float64
+}
+
+// maxHealthBody caps how much of a health response is searched for Body
+const maxHealthBody = 64 << 10
+
+// ParseStatusRange reads "200" or "200-399"
+func ParseStatusRange(s string) (lo, hi int, err error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if lo, err = strconv.Atoi(strings.TrimSpace(from)); err != nil {
+		return 0, 0, fmt.Errorf("invalid status range %q", s)
+	}
+	hi = lo
+	if isRange {
+		if hi, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+			return 0, 0, fmt.Errorf("invalid status range %q", s)
+		}
+	}
+	if lo < 100 || hi > 599 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid status range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// health state of a backend, guarded by Backend.mu
+type health struct {
+	// consecutive active check results
+	passes, fails int
+	// passive window
+	windowStart        time.Time
+	requests, failures int
+}
+
+// one active check against b
+func (hc *HealthCheck) probe(b *Backend) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	target := b.url.ResolveReference(&url.URL{Path: hc.Path})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < hc.StatusMin || resp.StatusCode > hc.StatusMax {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if hc.Body == "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), hc.Body) {
+		return fmt.Errorf("body doesn't contain %q", hc.Body)
+	}
+	return nil
+}
+
+// counts an active check result, flipping alive once a threshold is met.
+// Reports whether it flipped
+func (b *Backend) checked(err error, hc *HealthCheck) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.health.passes = 0
+		b.health.fails++
+		if b.alive && b.health.fails >= hc.Fall {
+			b.alive = false
+			return true
+		}
+		return false
+	}
+	b.health.fails = 0
+	b.health.passes++
+	if !b.alive && b.health.passes >= hc.Rise {
+		b.alive = true
+		// a fresh passive window, the failures that took it down are over
+		b.health.windowStart, b.health.requests, b.health.failures = time.Time{}, 0, 0
+		return true
+	}
+	return false
+}
+
+// counts a proxied request for passive checks. Reports whether b went down
+func (b *Backend) observed(failed bool, pc *PassiveCheck) bool {
+	if pc.MaxFailureRate <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := &b.health
+	if now := time.Now(); now.Sub(h.windowStart) > pc.Window {
+		h.windowStart, h.requests, h.failures = now, 0, 0
+	}
+	h.requests++
+	if failed {
+		h.failures++
+	}
+	if !b.alive || h.requests < pc.MinRequests {
+		return false
+	}
+	if float64(h.failures)/float64(h.requests) < pc.MaxFailureRate {
+		return false
+	}
+	b.alive = false
+	// active checks need Rise passes from here
+	h.passes = 0
+	return true
+}
+
+// passive result of a request proxied to b
+func (s *ServerPool) observe(b *Backend, failed bool) {
+	if b.observed(failed, &s.passive) {
+		log.Printf("%s [down] failure rate over %.0f%%", b.url, s.passive.MaxFailureRate*100)
+	}
+}
+
+// HealthCheck probes every backend at once and logs their state
+func (s *ServerPool) HealthCheck() {
+	var wg sync.WaitGroup
+	for _, b := range s.Backends() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.health.probe(b)
+			flipped := b.checked(err, &s.health)
+
+			status := "up"
+			if !b.IsAlive() {
+				status = "down"
+			}
+			if st := b.breaker.State(); st != breakerClosed {
+				status += ", breaker " + st.String()
+			}
+			switch {
+			case flipped && err != nil:
+				log.Printf("%s [%s] after %d failed checks, last: %v", b.url, status, s.health.Fall, err)
+			case flipped:
+				log.Printf("%s [%s] after %d passed checks", b.url, status, s.health.Rise)
+			case err != nil:
+				log.Printf("%s [%s] check failed: %v", b.url, status, err)
+			default:
+				log.Printf("%s [%s]", b.url, status)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func healthCheck() {
+	t := time.NewTicker(serverPool.health.Interval)
+	defer t.Stop()
+	for {
+		log.Println("Starting health check")
+		serverPool.HealthCheck()
+		log.Println("Completed health check")
+		<-t.C
+	}
+}
@@ -6,19 +6,24 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+type contextKey int
+
 const (
-	Attempt int = iota
-	Retry
+	// 1 based try number of the request
+	Attempt contextKey = iota
+	// where the proxy leaves the outcome of a try
+	proxyResult
 )
 
 var serverPool ServerPool
@@ -26,163 +31,400 @@ var serverPool ServerPool
 type Backend struct {
 	url          *url.URL
 	alive        bool
-	mu           *sync.RWMutex
+	mu           sync.RWMutex
 	reverseProxy *httputil.ReverseProxy
+	// relative share of traffic for weighted strategies, at least 1
+	weight int
+	// requests being proxied right now
+	inFlight atomic.Int64
+	// moving average of response times in nanoseconds, 0 until the first
+	// response
+	responseTime atomic.Int64
+	health       health
+	// nil when circuit breaking is off
+	breaker *breaker
+	// set while the backend is being drained, it gets no new requests
+	draining atomic.Bool
 }
 
+// newBackend sets up the proxy to u, reporting each try's outcome to serve
+func newBackend(u *url.URL, weight int) *Backend {
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if res, ok := resp.Request.Context().Value(proxyResult).(*attemptResult); ok {
+			res.status = resp.StatusCode
+		}
+		return nil
+	}
+	// loadbalance decides whether to retry
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("[%s] attempt %d errored: %v", u.Host, getAttemptFromRequest(r), err)
+		if res, ok := r.Context().Value(proxyResult).(*attemptResult); ok {
+			res.err = err
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return &Backend{
+		url:          u,
+		alive:        true,
+		reverseProxy: proxy,
+		weight:       weight,
+		breaker:      newBreaker(&serverPool.breaker, u.String()),
+	}
+}
+
+// how much a new sample moves the response time average
+const responseTimeDecay = 0.2
+
 func (b *Backend) IsAlive() bool {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	return b.alive
 }
 
-func (b *Backend) SetAlive(alive bool) {
-	b.mu.Lock()
-	b.alive = alive
-	b.mu.Unlock()
+func (b *Backend) Weight() int {
+	return max(b.weight, 1)
 }
 
-type ServerPool struct {
-	backends []*Backend
-	// active index
-	active uint32
+func (b *Backend) InFlight() int64 {
+	return b.inFlight.Load()
 }
 
-func (s *ServerPool) AddBackend(be *Backend) {
-	s.backends = append(s.backends, be)
+func (b *Backend) ResponseTime() time.Duration {
+	return time.Duration(b.responseTime.Load())
 }
 
-func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint32(&s.active, 1) % uint32(len(s.backends)))
+func (b *Backend) observe(d time.Duration) {
+	for {
+		old := b.responseTime.Load()
+		next := int64(d)
+		if old != 0 {
+			next = old + int64(responseTimeDecay*float64(int64(d)-old))
+		}
+		if b.responseTime.CompareAndSwap(old, next) {
+			return
+		}
+	}
 }
 
-func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
-	for _, be := range s.backends {
-		if be.url.String() != backendUrl.String() {
-			continue
-		}
-		be.SetAlive(alive)
+// reports whether b is alive, not draining and its breaker lets requests
+// through
+func (b *Backend) available() bool {
+	return !b.draining.Load() && b.IsAlive() && b.breaker.available()
+}
+
+// counts a request in flight on b and takes a probe slot when its breaker is
+// half-open. False when b is draining or has no slot left, nothing is taken
+// then. Draining is checked after counting so a drain either waits for the
+// request or the request stays off b
+func (b *Backend) admit() bool {
+	b.inFlight.Add(1)
+	if b.draining.Load() || !b.breaker.acquire() {
+		b.inFlight.Add(-1)
+		return false
 	}
+	return true
 }
 
-func (s *ServerPool) GetNextPeer() *Backend {
-	next, beLen := s.NextIndex(), len(s.backends)
-	l := next + beLen
+// what the proxy saw of one try
+type attemptResult struct {
+	status int
+	err    error
+}
 
-	for i := next; i < l; i++ {
-		idx := i % beLen
+// proxies r to b, which admitted it, and stops counting it in flight after.
+// Returns the error when b couldn't be reached, nothing was written to w
+// then. 5xx responses and errors count against b's passive check and breaker
+func (b *Backend) serve(w http.ResponseWriter, r *http.Request) error {
+	defer b.inFlight.Add(-1)
+	var res attemptResult
+	r = r.WithContext(context.WithValue(r.Context(), proxyResult, &res))
+	start := time.Now()
+	b.reverseProxy.ServeHTTP(w, r)
 
-		if s.backends[idx].IsAlive() {
-			if i != next {
-				atomic.StoreUint32(&s.active, uint32(idx))
-			}
-			return s.backends[idx]
-		}
+	// a client hanging up says nothing about the backend
+	if r.Context().Err() != nil {
+		b.breaker.release()
+		return res.err
 	}
-	return nil
+	failed := res.err != nil || res.status >= 500
+	serverPool.observe(b, failed)
+	b.breaker.record(failed)
+	if res.err == nil {
+		b.observe(time.Since(start))
+	}
+	return res.err
 }
 
-func (s *ServerPool) HealthCheck() {
-	for _, b := range s.backends {
-		status := "up"
-		alive := isBackendAlive(b.url)
-		b.SetAlive(alive)
-		if !alive {
-			status = "down"
+type ServerPool struct {
+	// replaced, never modified in place, so a snapshot can be read without
+	// holding mu
+	mu       sync.RWMutex
+	backends []*Backend
+	strategy Strategy
+	// nil without sticky sessions
+	sticky  *Sticky
+	health  HealthCheck
+	passive PassiveCheck
+	retry   RetryPolicy
+	breaker BreakerConfig
+}
+
+// Backends returns the current backends, the slice must not be modified
+func (s *ServerPool) Backends() []*Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backends
+}
+
+// AddBackend adds be unless a backend with its url is in the pool
+func (s *ServerPool) AddBackend(be *Backend) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.ContainsFunc(s.backends, func(b *Backend) bool { return b.url.String() == be.url.String() }) {
+		return false
+	}
+	s.backends = append(slices.Clip(s.backends), be)
+	s.backendsChanged()
+	return true
+}
+
+// Backend returns the backend for u, nil when there is none
+func (s *ServerPool) Backend(u string) *Backend {
+	for _, be := range s.Backends() {
+		if be.url.String() == u {
+			return be
 		}
-		log.Printf("%s [%s]\n", b.url, status)
 	}
+	return nil
 }
 
-func isBackendAlive(url *url.URL) bool {
-	conn, err := net.DialTimeout("tcp", url.String(), 2*time.Second)
-	if err != nil {
-		log.Printf("site unreachable to %s, err: %v", url.String(), err)
+// RemoveBackend takes be out of the pool right away, in flight requests
+// still finish
+func (s *ServerPool) RemoveBackend(be *Backend) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.Index(s.backends, be)
+	if i < 0 {
 		return false
 	}
-	defer conn.Close()
+	s.backends = slices.Delete(slices.Clone(s.backends), i, i+1)
+	s.backendsChanged()
 	return true
 }
 
-func getAttemptFromRequest(r *http.Request) int {
-	if retry, ok := r.Context().Value(Retry).(int); ok {
-		return retry
+// tells a strategy tracking the whole pool about the new backends, caller
+// holds s.mu
+func (s *ServerPool) backendsChanged() {
+	if ps, ok := s.strategy.(poolStrategy); ok {
+		ps.setBackends(s.backends)
+	}
+}
+
+// GetNextPeer picks an available backend that admits r, counting r in
+// flight there. Backends in tried are only picked when no other is available
+func (s *ServerPool) GetNextPeer(r *http.Request, tried ...*Backend) *Backend {
+	backends := s.Backends()
+	var skip []*Backend
+	for {
+		alive := make([]*Backend, 0, len(backends))
+		for _, be := range backends {
+			if be.available() && !slices.Contains(tried, be) && !slices.Contains(skip, be) {
+				alive = append(alive, be)
+			}
+		}
+		if len(alive) == 0 && len(tried) > 0 {
+			tried = nil
+			continue
+		}
+		peer := s.strategy.Next(alive, r)
+		if peer == nil || peer.admit() {
+			return peer
+		}
+		// it started draining or another request took the last probe slot
+		// meanwhile
+		skip = append(skip, peer)
 	}
-	return 1
 }
 
-func getRetryFromRequest(r *http.Request) int {
+// backend for a try of r: the one r is pinned to when it can take it,
+// otherwise the strategy's pick, pinned from then on. r is counted in flight
+// on it until serve returns
+func (s *ServerPool) pick(w http.ResponseWriter, r *http.Request, tried []*Backend) *Backend {
+	if peer := s.sticky.Peer(r, s.Backends()); peer != nil && !slices.Contains(tried, peer) && peer.admit() {
+		return peer
+	}
+	peer := s.GetNextPeer(r, tried...)
+	if peer != nil {
+		s.sticky.Pin(w, peer)
+	}
+	return peer
+}
+
+func getAttemptFromRequest(r *http.Request) int {
 	if attempt, ok := r.Context().Value(Attempt).(int); ok {
 		return attempt
 	}
-	return 0
+	return 1
 }
 
 func loadbalance(w http.ResponseWriter, r *http.Request) {
-	attempt := getAttemptFromRequest(r)
-	if attempt > 3 {
-		log.Printf("%s(%s) Max attempt reached, terminated\n", r.RemoteAddr, r.URL.Path)
-		http.Error(w, "Maximum attempt reached", http.StatusServiceUnavailable)
+	policy := &serverPool.retry
+	policy.Budget.deposit()
+	maxAttempts := policy.attempts(r)
+	body, replayable, err := replayableBody(r, policy.MaxBodyBuffer)
+	if err != nil {
+		http.Error(w, "Reading request body failed", http.StatusBadRequest)
 		return
 	}
+	if !replayable {
+		maxAttempts = 1
+	}
+
+	var tried []*Backend
+	for attempt := 1; ; attempt++ {
+		peer := serverPool.pick(w, r, tried)
+		if peer == nil {
+			http.Error(w, "Service not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		err := peer.serve(w, attemptRequest(r, body, attempt))
+		if err == nil {
+			return
+		}
+		tried = append(tried, peer)
 
-	peer := serverPool.GetNextPeer()
-	if peer == nil {
-		http.Error(w, "Service not available", http.StatusServiceUnavailable)
+		switch {
+		case r.Context().Err() != nil:
+			// the client went away
+			return
+		case attempt >= maxAttempts:
+			log.Printf("%s(%s) Max attempt reached, terminated\n", r.RemoteAddr, r.URL.Path)
+		case !policy.retryable(r, err):
+			log.Printf("%s(%s) %s may have reached the backend, not retried\n", r.RemoteAddr, r.URL.Path, r.Method)
+		case !policy.Budget.withdraw():
+			log.Printf("%s(%s) Retry budget spent, terminated\n", r.RemoteAddr, r.URL.Path)
+		case !policy.wait(r.Context(), attempt):
+			return
+		default:
+			log.Printf("%s(%s) Attempt retry %d\n", r.RemoteAddr, r.URL.Path, attempt+1)
+			continue
+		}
+		http.Error(w, "Backend unavailable", http.StatusBadGateway)
 		return
 	}
-
-	peer.reverseProxy.ServeHTTP(w, r)
 }
-func healthCheck() {
-	t := time.NewTicker(2 * time.Minute)
-	defer t.Stop()
-	for range t.C {
-		log.Println("Starting health check")
-		serverPool.HealthCheck()
-		log.Println("Completed health check")
+
+func parseWeights(list string, n int) ([]int, error) {
+	weights := make([]int, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	if list == "" {
+		return weights, nil
 	}
+	fields := strings.Split(list, ",")
+	if len(fields) > n {
+		return nil, fmt.Errorf("%d weights for %d backends", len(fields), n)
+	}
+	for i, f := range fields {
+		w, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("invalid weight %q", f)
+		}
+		weights[i] = w
+	}
+	return weights, nil
 }
 
 func main() {
-	var serverList string
+	var serverList, weightList, strategy, hashKey, stickyCookie string
+	var stickyTTL, drainTimeout time.Duration
+	var adminAddr string
+	var healthStatus, retryRoutes string
+	var retryBudget, retryBudgetMin float64
 	var port int
 	flag.StringVar(&serverList, "backends", "", "Load balancer backends. Use comma to seperate")
+	flag.StringVar(&weightList, "weights", "", "Backend weights in the order of -backends, comma seperated. 1 when missing")
+	flag.StringVar(&strategy, "strategy", "round-robin", "Balancing strategy: "+strategyNames())
+	flag.StringVar(&hashKey, "hash-key", "ip", "What the hash strategy hashes requests on: ip, header:<name> or cookie:<name>")
+	flag.StringVar(&stickyCookie, "sticky", "", "Cookie pinning clients to a backend, no sticky sessions when empty")
+	flag.DurationVar(&stickyTTL, "sticky-ttl", time.Hour, "How long sticky session cookies last")
+	flag.StringVar(&serverPool.health.Path, "health-path", "/", "Path health checks request")
+	flag.StringVar(&healthStatus, "health-status", "200-399", "Status codes passing a health check, a code or a range")
+	flag.StringVar(&serverPool.health.Body, "health-body", "", "Text a passing health check response contains")
+	flag.DurationVar(&serverPool.health.Timeout, "health-timeout", 2*time.Second, "Health check timeout")
+	flag.DurationVar(&serverPool.health.Interval, "health-interval", 10*time.Second, "Time between health checks")
+	flag.IntVar(&serverPool.health.Rise, "health-rise", 2, "Passed checks before a down backend is up")
+	flag.IntVar(&serverPool.health.Fall, "health-fall", 3, "Failed checks before an up backend is down")
+	flag.DurationVar(&serverPool.passive.Window, "passive-window", 30*time.Second, "Window proxied request failures are counted over")
+	flag.IntVar(&serverPool.passive.MinRequests, "passive-min", 20, "Requests in a window before its failure rate counts")
+	flag.Float64Var(&serverPool.passive.MaxFailureRate, "passive-rate", 0.5, "5xx and error rate taking a backend down, 0 disables")
+	flag.IntVar(&serverPool.retry.MaxAttempts, "retry-attempts", 3, "Tries per request across backends, including the first")
+	flag.StringVar(&retryRoutes, "retry-routes", "", "Tries for path prefixes, e.g. /pay=1,/search=4")
+	flag.Int64Var(&serverPool.retry.MaxBodyBuffer, "retry-body-max", 1<<20, "Largest request body buffered for retries, larger ones are tried once")
+	flag.DurationVar(&serverPool.retry.Backoff, "retry-backoff", 10*time.Millisecond, "Backoff before the first retry, doubling each retry")
+	flag.DurationVar(&serverPool.retry.MaxBackoff, "retry-backoff-max", time.Second, "Longest backoff between retries")
+	flag.Float64Var(&retryBudget, "retry-budget", 0.2, "Retries allowed per request on average, 0 is unlimited")
+	flag.Float64Var(&retryBudgetMin, "retry-budget-min", 10, "Retries per second allowed regardless of the budget")
+	flag.IntVar(&serverPool.breaker.ConsecutiveFailures, "breaker-failures", 5, "Consecutive failures opening a backend's circuit breaker, 0 disables")
+	flag.Float64Var(&serverPool.breaker.FailureRate, "breaker-rate", 0.5, "Failure rate opening a backend's circuit breaker, 0 disables")
+	flag.IntVar(&serverPool.breaker.MinRequests, "breaker-min", 10, "Requests in a window before its failure rate counts")
+	flag.DurationVar(&serverPool.breaker.Window, "breaker-window", 10*time.Second, "Window the breaker failure rate is counted over")
+	flag.DurationVar(&serverPool.breaker.OpenTimeout, "breaker-open", 10*time.Second, "How long an open breaker rejects requests before probing")
+	flag.IntVar(&serverPool.breaker.Probes, "breaker-probes", 3, "Probe requests a half-open breaker lets through, all must pass to close")
+	flag.StringVar(&adminAddr, "admin", "127.0.0.1:3031", "Admin API address, keep it local. Disabled when empty")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "How long removing a backend waits for its in flight requests")
 	flag.IntVar(&port, "port", 3030, "Ports to serve ")
 	flag.Parse()
 
-	urls := strings.Split(serverList, ",")
-	for _, urlStr := range urls {
-		serverUrl, err := url.Parse(urlStr)
+	if serverPool.health.Interval <= 0 || serverPool.health.Timeout <= 0 {
+		log.Fatal("health interval and timeout must be positive")
+	}
+	serverPool.health.Rise, serverPool.health.Fall = max(serverPool.health.Rise, 1), max(serverPool.health.Fall, 1)
+	serverPool.breaker.Probes = max(serverPool.breaker.Probes, 1)
+
+	key, err := ParseHashKey(hashKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if serverPool.health.StatusMin, serverPool.health.StatusMax, err = ParseStatusRange(healthStatus); err != nil {
+		log.Fatal(err)
+	}
+	if serverPool.retry.Routes, err = ParseRoutes(retryRoutes); err != nil {
+		log.Fatal(err)
+	}
+	if retryBudget > 0 {
+		serverPool.retry.Budget = NewRetryBudget(retryBudget, retryBudgetMin)
+	}
+	if serverPool.strategy, err = NewStrategy(strategy, key); err != nil {
+		log.Fatal(err)
+	}
+	if stickyCookie != "" {
+		serverPool.sticky = &Sticky{Cookie: stickyCookie, MaxAge: stickyTTL}
+	}
+
+	// backends may also come later over the admin API
+	var urls []string
+	if serverList != "" {
+		urls = strings.Split(serverList, ",")
+	}
+	weights, err := parseWeights(weightList, len(urls))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, urlStr := range urls {
+		serverUrl, err := parseBackendURL(strings.TrimSpace(urlStr))
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		proxy := httputil.NewSingleHostReverseProxy(serverUrl)
-		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Printf("[%s] errored: %v", r.Host, err)
-			retries := getRetryFromRequest(r)
-			if retries < 3 {
-				time.Sleep(10 * time.Millisecond)
-				ctx := context.WithValue(r.Context(), Retry, retries+1)
-				proxy.ServeHTTP(w, r.WithContext(ctx))
-				return
-			}
-
-			serverPool.MarkBackendStatus(serverUrl, false)
-
-			attempt := getAttemptFromRequest(r)
-			log.Printf("%s(%s) Attempt retry %d\n", r.RemoteAddr, r.URL.Path, attempt)
-			ctx := context.WithValue(r.Context(), Attempt, attempt+1)
-			loadbalance(w, r.WithContext(ctx))
+		if !serverPool.AddBackend(newBackend(serverUrl, weights[i])) {
+			log.Fatalf("backend %s listed twice", serverUrl)
 		}
-
-		serverPool.AddBackend(&Backend{
-			url:          serverUrl,
-			alive:        true,
-			reverseProxy: proxy,
-		})
-		log.Printf("Configure server: %s\n", serverUrl)
+		log.Printf("Configure server: %s weight %d\n", serverUrl, weights[i])
 	}
 
 	server := http.Server{
@@ -191,8 +433,14 @@ func main() {
 	}
 
 	go healthCheck()
+	if adminAddr != "" {
+		go func() {
+			log.Printf("Admin API at: %s", adminAddr)
+			log.Fatalln(http.ListenAndServe(adminAddr, adminHandler(drainTimeout)))
+		}()
+	}
 
-	log.Printf("Load balancer started at: %d", port)
+	log.Printf("Load balancer started at: %d using %s", port, strategy)
 	if err := server.ListenAndServe(); err != nil {
 		log.Fatalln(err)
 	}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy decides whether a request that failed on one backend is tried
+// on another, and when
+type RetryPolicy struct {
+	// tries per request including the first
+	MaxAttempts int
+	// MaxAttempts overrides for path prefixes, the longest match wins
+	Routes map[string]int
+	// request bodies up to this size are buffered so they can be sent
+	// again, larger ones get a single attempt
+	MaxBodyBuffer int64
+	// delay before the first retry, doubling up to MaxBackoff
+	Backoff, MaxBackoff time.Duration
+	// nil retries without limit
+	Budget *RetryBudget
+}
+
+// ParseRoutes reads "/prefix=attempts,..."
+func ParseRoutes(s string) (map[string]int, error) {
+	routes := map[string]int{}
+	if s == "" {
+		return routes, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		prefix, n, ok := strings.Cut(strings.TrimSpace(f), "=")
+		attempts, err := strconv.Atoi(n)
+		if !ok || !strings.HasPrefix(prefix, "/") || err != nil || attempts < 1 {
+			return nil, fmt.Errorf("invalid route %q, want /prefix=attempts", f)
+		}
+		routes[prefix] = attempts
+	}
+	return routes, nil
+}
+
+// tries allowed for r
+func (p *RetryPolicy) attempts(r *http.Request) int {
+	n, longest := p.MaxAttempts, -1
+	for prefix, attempts := range p.Routes {
+		if len(prefix) > longest && strings.HasPrefix(r.URL.Path, prefix) {
+			n, longest = attempts, len(prefix)
+		}
+	}
+	return max(n, 1)
+}
+
+// idempotent requests can be sent again whatever happened to the last try.
+// Others only when the backend can't have seen them
+func (p *RetryPolicy) retryable(r *http.Request, err error) bool {
+	if idempotent(r) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
+
+// exponential backoff with full jitter so clients failing together don't
+// retry together
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := p.Backoff << min(retry-1, 30)
+	if d <= 0 || d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// waits out the backoff of retry, false when the client went away meanwhile
+func (p *RetryPolicy) wait(ctx context.Context, retry int) bool {
+	t := time.NewTimer(p.backoff(retry))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// replayableBody buffers r's body so every attempt sends it again. When the
+// body is over limit it returns false and r keeps a body readable once
+func replayableBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	return buf, true, nil
+}
+
+// request for one attempt, with its own copy of the buffered body
+func attemptRequest(r *http.Request, body []byte, attempt int) *http.Request {
+	ar := r.WithContext(context.WithValue(r.Context(), Attempt, attempt))
+	if body != nil {
+		ar.Body = io.NopCloser(bytes.NewReader(body))
+		ar.ContentLength = int64(len(body))
+		ar.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	}
+	return ar
+}
+
+// RetryBudget caps retries to a share of recent traffic so an outage
+// doesn't multiply the load on what's left. Every request adds Ratio
+// tokens, every retry takes one, MinPerSecond tokens trickle in regardless
+type RetryBudget struct {
+	Ratio        float64
+	MinPerSecond float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// most tokens saved up, bounds the burst after a quiet period
+const maxRetryTokens = 100
+
+func NewRetryBudget(ratio, minPerSecond float64) *RetryBudget {
+	return &RetryBudget{Ratio: ratio, MinPerSecond: minPerSecond, last: time.Now()}
+}
+
+func (b *RetryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens = min(b.tokens+b.Ratio, maxRetryTokens)
+	b.mu.Unlock()
+}
+
+// takes a token for a retry, false when the budget is spent
+func (b *RetryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.MinPerSecond, maxRetryTokens)
+	b.last = now
+	// ratios like 0.2 add up to just under whole tokens
+	if b.tokens < 1-1e-9 {
+		return false
+	}
+	b.tokens = max(b.tokens-1, 0)
+	return true
+}
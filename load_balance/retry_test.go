@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name        string
+		ratio, min  float64
+		requests    int
+		quiet       time.Duration
+		wantRetries int
+	}{
+		{name: "share of requests", ratio: 0.2, requests: 10, wantRetries: 2},
+		{name: "partial token", ratio: 0.5, requests: 3, wantRetries: 1},
+		{name: "no traffic", ratio: 0.2, wantRetries: 0},
+		{name: "minimum per second", ratio: 0.2, min: 10, quiet: 500 * time.Millisecond, wantRetries: 5},
+		{name: "minimum adds to requests", ratio: 0.5, min: 4, requests: 4, quiet: time.Second, wantRetries: 6},
+		{name: "capped after a quiet period", ratio: 0.2, min: 10, quiet: time.Hour, wantRetries: maxRetryTokens},
+		{name: "capped deposits", ratio: 1, requests: 2 * maxRetryTokens, wantRetries: maxRetryTokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewRetryBudget(tt.ratio, tt.min)
+			b.last = time.Now().Add(-tt.quiet)
+			for range tt.requests {
+				b.deposit()
+			}
+			retries := 0
+			for b.withdraw() && retries <= 2*maxRetryTokens {
+				retries++
+			}
+			if retries != tt.wantRetries {
+				t.Fatalf("%d retries allowed, want %d", retries, tt.wantRetries)
+			}
+		})
+	}
+
+	var unlimited *RetryBudget
+	unlimited.deposit()
+	if !unlimited.withdraw() {
+		t.Fatal("nil budget refused a retry")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name                string
+		backoff, maxBackoff time.Duration
+		retry               int
+		// backoffs are drawn from [0, limit)
+		limit time.Duration
+	}{
+		{"first retry", 10 * time.Millisecond, time.Second, 1, 10 * time.Millisecond},
+		{"doubling", 10 * time.Millisecond, time.Second, 3, 40 * time.Millisecond},
+		{"capped", 10 * time.Millisecond, time.Second, 10, time.Second},
+		{"shift overflow", 10 * time.Millisecond, time.Second, 100, time.Second},
+		{"no backoff", 0, 0, 1, 0},
+		{"max only", 0, 50 * time.Millisecond, 2, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := RetryPolicy{Backoff: tt.backoff, MaxBackoff: tt.maxBackoff}
+			var longest time.Duration
+			for range 1000 {
+				d := p.backoff(tt.retry)
+				if d < 0 || (d >= tt.limit && tt.limit > 0) || (tt.limit == 0 && d != 0) {
+					t.Fatalf("backoff %v outside [0, %v)", d, tt.limit)
+				}
+				longest = max(longest, d)
+			}
+			// full jitter spreads over the whole range
+			if longest < tt.limit/2 {
+				t.Fatalf("longest of 1000 backoffs %v, limit %v", longest, tt.limit)
+			}
+		})
+	}
+}
+
+func TestRetryWaitCancelled(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Hour, MaxBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if p.wait(ctx, 1) {
+		t.Fatal("wait returned true for a client that went away")
+	}
+}
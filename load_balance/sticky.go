@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sticky pins clients to the backend that served them first with a cookie.
+// A client whose backend went down is balanced again and re-pinned
+type Sticky struct {
+	Cookie string
+	MaxAge time.Duration
+}
+
+// cookie value naming b, the backend url itself stays private
+func stickyID(b *Backend) string {
+	return strconv.FormatUint(hashString(b.url.String()), 36)
+}
+
+// backend r is pinned to, nil when it has none or it can't take requests. A nil
+// Sticky pins nothing
+func (s *Sticky) Peer(r *http.Request, backends []*Backend) *Backend {
+	if s == nil {
+		return nil
+	}
+	c, err := r.Cookie(s.Cookie)
+	if err != nil {
+		return nil
+	}
+	for _, b := range backends {
+		if stickyID(b) == c.Value {
+			if b.available() {
+				return b
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// Pin sets the cookie for b on the response, replacing one an earlier
+// attempt of the same request set
+func (s *Sticky) Pin(w http.ResponseWriter, b *Backend) {
+	if s == nil {
+		return
+	}
+	h := w.Header()
+	cookies := h["Set-Cookie"][:0]
+	for _, v := range h["Set-Cookie"] {
+		if !strings.HasPrefix(v, s.Cookie+"=") {
+			cookies = append(cookies, v)
+		}
+	}
+	h["Set-Cookie"] = cookies
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.Cookie,
+		Value:    stickyID(b),
+		Path:     "/",
+		MaxAge:   int(s.MaxAge / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
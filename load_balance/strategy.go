@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy picks the backend for a request out of the alive ones
+type Strategy interface {
+	Next(alive []*Backend, r *http.Request) *Backend
+}
+
+// poolStrategy is a Strategy keeping state over every backend of the pool,
+// it is told the new set whenever a backend is added or removed
+type poolStrategy interface {
+	setBackends(all []*Backend)
+}
+
+var strategies = map[string]func(key HashKey) Strategy{
+	"round-robin": func(HashKey) Strategy { return &roundRobin{} },
+	"weighted":    func(HashKey) Strategy { return &weightedRoundRobin{current: map[*Backend]int{}} },
+	"least-conn":  func(HashKey) Strategy { return &leastConn{} },
+	"least-time":  func(HashKey) Strategy { return &leastTime{} },
+	"p2c":         func(HashKey) Strategy { return powerOfTwo{} },
+	"hash":        func(key HashKey) Strategy { return &consistentHash{key: key} },
+}
+
+func strategyNames() string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// NewStrategy returns the strategy called name, key is what the hash
+// strategy hashes requests on
+func NewStrategy(name string, key HashKey) (Strategy, error) {
+	newFn, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q, one of: %s", name, strategyNames())
+	}
+	return newFn(key), nil
+}
+
+type roundRobin struct {
+	next atomic.Uint32
+}
+
+func (s *roundRobin) Next(alive []*Backend, _ *http.Request) *Backend {
+	if len(alive) == 0 {
+		return nil
+	}
+	return alive[int(s.next.Add(1)-1)%len(alive)]
+}
+
+// smooth weighted round robin as in nginx: every pick each backend gains its
+// weight, the leader is picked and pays back the total. Spreads heavy
+// backends out instead of sending them bursts
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func (s *weightedRoundRobin) Next(alive []*Backend, _ *http.Request) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// forget backends that left, returning ones start over
+	if len(s.current) > len(alive) {
+		for b := range s.current {
+			if !slices.Contains(alive, b) {
+				delete(s.current, b)
+			}
+		}
+	}
+
+	var best *Backend
+	total := 0
+	for _, b := range alive {
+		w := b.Weight()
+		s.current[b] += w
+		total += w
+		if best == nil || s.current[b] > s.current[best] {
+			best = b
+		}
+	}
+	if best != nil {
+		s.current[best] -= total
+	}
+	return best
+}
+
+// fewest in flight requests relative to weight, ties rotate so an idle pool
+// doesn't send everything to the first backend
+type leastConn struct {
+	next atomic.Uint32
+}
+
+func (s *leastConn) Next(alive []*Backend, _ *http.Request) *Backend {
+	if len(alive) == 0 {
+		return nil
+	}
+	start := int(s.next.Add(1)-1) % len(alive)
+	best := alive[start]
+	for i := 1; i < len(alive); i++ {
+		b := alive[(start+i)%len(alive)]
+		if lessLoaded(b, best) {
+			best = b
+		}
+	}
+	return best
+}
+
+// a carries less in flight per unit of weight than b
+func lessLoaded(a, b *Backend) bool {
+	return a.InFlight()*int64(b.Weight()) < b.InFlight()*int64(a.Weight())
+}
+
+// lowest average response time scaled by the requests already waiting on
+// it. Backends without samples yet are tried first
+type leastTime struct {
+	next atomic.Uint32
+}
+
+func (s *leastTime) Next(alive []*Backend, _ *http.Request) *Backend {
+	if len(alive) == 0 {
+		return nil
+	}
+	start := int(s.next.Add(1)-1) % len(alive)
+	var best *Backend
+	var bestCost float64
+	for i := range alive {
+		b := alive[(start+i)%len(alive)]
+		cost := float64(b.ResponseTime()) * float64(b.InFlight()+1) / float64(b.Weight())
+		if best == nil || cost < bestCost {
+			best, bestCost = b, cost
+		}
+	}
+	return best
+}
+
+// power of two choices: the less loaded of two random backends. Close to
+// least connections without every request scanning, and no herding onto
+// one backend when the counters lag
+type powerOfTwo struct{}
+
+func (powerOfTwo) Next(alive []*Backend, _ *http.Request) *Backend {
+	switch len(alive) {
+	case 0:
+		return nil
+	case 1:
+		return alive[0]
+	}
+	i := rand.IntN(len(alive))
+	j := rand.IntN(len(alive) - 1)
+	if j >= i {
+		j++
+	}
+	if lessLoaded(alive[j], alive[i]) {
+		return alive[j]
+	}
+	return alive[i]
+}